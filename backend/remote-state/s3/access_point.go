@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+)
+
+// accessPoint is an S3 access point, given as the bucket by its ARN, e.g.
+// arn:aws:s3:us-west-2:123456789012:accesspoint/state.
+type accessPoint struct {
+	Partition string
+	Region    string
+	AccountID string
+	Name      string
+}
+
+// parseAccessPointARN parses an access point ARN, returning false if s
+// isn't one.
+func parseAccessPointARN(s string) (*accessPoint, bool) {
+	parts := strings.SplitN(s, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "s3" {
+		return nil, false
+	}
+
+	// The resource is accesspoint/name or accesspoint:name.
+	resource := parts[5]
+	i := strings.IndexAny(resource, "/:")
+	if i < 0 || resource[:i] != "accesspoint" {
+		return nil, false
+	}
+	name := resource[i+1:]
+	if name == "" || parts[3] == "" || parts[4] == "" || strings.ContainsAny(name, "/:") {
+		return nil, false
+	}
+
+	return &accessPoint{
+		Partition: parts[1],
+		Region:    parts[3],
+		AccountID: parts[4],
+		Name:      name,
+	}, true
+}
+
+// Host returns the endpoint host of the access point.
+func (a *accessPoint) Host() string {
+	domain := "amazonaws.com"
+	if a.Partition == "aws-cn" {
+		domain = "amazonaws.com.cn"
+	}
+	return fmt.Sprintf("%s-%s.s3-accesspoint.%s.%s", a.Name, a.AccountID, a.Region, domain)
+}
+
+// routeToAccessPoint returns a Build handler that sends requests for the
+// access point ARN to the access point's endpoint, in the access point's
+// region. The vendored SDK predates access points, so it would otherwise put
+// the ARN in the request path.
+func routeToAccessPoint(arn string, a *accessPoint) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "terraform.s3.RouteToAccessPointHandler",
+		Fn: func(r *request.Request) {
+			u := r.HTTPRequest.URL
+			prefix := "/" + arn
+			if !strings.HasPrefix(u.Path, prefix) {
+				return
+			}
+
+			u.Host = a.Host()
+			u.Path = strings.TrimPrefix(u.Path, prefix)
+			u.RawPath = strings.TrimPrefix(u.RawPath, "/"+rest.EscapePath(arn, true))
+			if u.Path == "" {
+				u.Path = "/"
+				u.RawPath = "/"
+			}
+
+			r.ClientInfo.SigningRegion = a.Region
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package s3
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/backend"
+)
+
+func TestParseAccessPointARN(t *testing.T) {
+	for _, tc := range []struct {
+		arn  string
+		want *accessPoint
+	}{
+		{
+			"arn:aws:s3:us-west-2:123456789012:accesspoint/state",
+			&accessPoint{"aws", "us-west-2", "123456789012", "state"},
+		},
+		{
+			"arn:aws-cn:s3:cn-north-1:123456789012:accesspoint:state",
+			&accessPoint{"aws-cn", "cn-north-1", "123456789012", "state"},
+		},
+		{"tf-test", nil},
+		{"arn:aws:s3:::tf-test", nil},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/", nil},
+		{"arn:aws:s3:us-west-2:123456789012:accesspoint/state/object", nil},
+		{"arn:aws:s3-object-lambda:us-west-2:123456789012:accesspoint/state", nil},
+	} {
+		got, ok := parseAccessPointARN(tc.arn)
+		if ok != (tc.want != nil) || !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%q: expected %#v, got %#v", tc.arn, tc.want, got)
+		}
+	}
+}
+
+func TestBackendConfig_accessPoint(t *testing.T) {
+	arn := "arn:aws:s3:us-east-1:123456789012:accesspoint/state"
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 arn,
+		"key":                    "path/to/state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := b.client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload.Data) != "test state" {
+		t.Fatalf("unexpected state: %q", payload.Data)
+	}
+	if err := b.client.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"PutObject", "GetObject", "DeleteObject"} {
+		r := stub.requests(op)[0]
+		u := r.HTTPRequest.URL
+		if u.Host != "state-123456789012.s3-accesspoint.us-east-1.amazonaws.com" {
+			t.Fatalf("%s: request wasn't sent to the access point: %s", op, u)
+		}
+		if u.Path != "/path/to/state" {
+			t.Fatalf("%s: expected path %q, got %q", op, "/path/to/state", u.Path)
+		}
+		if r.ClientInfo.SigningRegion != "us-east-1" {
+			t.Fatalf("%s: expected the request to be signed for us-east-1, got %q", op, r.ClientInfo.SigningRegion)
+		}
+	}
+
+	config["force_path_style"] = true
+	if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "access point") {
+		t.Fatalf("expected an error about the access point, got %v", err)
+	}
+}
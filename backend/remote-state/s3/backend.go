@@ -2,17 +2,33 @@ package s3
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	cleanhttp "github.com/hashicorp/go-cleanhttp"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/backend"
+	"github.com/hashicorp/terraform/helper/logging"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 
 	terraformAWS "github.com/hashicorp/terraform/builtin/providers/aws"
 )
@@ -24,13 +40,28 @@ func New() backend.Backend {
 			"bucket": &schema.Schema{
 				Type:        schema.TypeString,
 				Required:    true,
-				Description: "The name of the S3 bucket",
+				Description: "The name of the S3 bucket, or the ARN of an S3 access point",
 			},
 
 			"key": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The path to the state file inside the bucket",
+				ValidateFunc: validateKey,
+			},
+
+			"key_template": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The path to the state files of each workspace, with {workspace} replaced by the workspace name, instead of key",
+				ValidateFunc: validateKeyTemplate,
+			},
+
+			"workspace_key_separator": &schema.Schema{
 				Type:        schema.TypeString,
-				Required:    true,
-				Description: "The path to the state file inside the bucket",
+				Optional:    true,
+				Description: "The separator joining the workspace prefix, the workspace name and key in the keys of workspace states",
+				Default:     "/",
 			},
 
 			"region": &schema.Schema{
@@ -61,6 +92,64 @@ func New() backend.Backend {
 				Default:     "",
 			},
 
+			"request_payer": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Set to requester to access a Requester Pays bucket",
+				Default:      "",
+				ValidateFunc: validation.StringInSlice([]string{s3.RequestPayerRequester}, false),
+			},
+
+			"expected_bucket_owner": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The account ID that must own the bucket",
+				Default:      "",
+				ValidateFunc: validateAccountID,
+			},
+
+			"bootstrap_bucket": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Create the bucket, with versioning, encryption and public access blocked, if it doesn't exist",
+				Default:     false,
+			},
+
+			"skip_encryption_check": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Skip checking that the bucket has default encryption when encrypt is false",
+				Default:     false,
+			},
+
+			"manage_bucket_logging": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Enable access logging of the bucket to logging_target_bucket",
+				Default:     false,
+			},
+
+			"logging_target_bucket": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The bucket access logs are delivered to",
+				Default:     "",
+			},
+
+			"logging_target_prefix": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The prefix of the access log objects",
+				Default:     "",
+			},
+
+			"skip_acl": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Don't apply acl, for buckets with ACLs disabled",
+				Default:     false,
+			},
+
 			"access_key": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -78,10 +167,23 @@ func New() backend.Backend {
 			"kms_key_id": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
-				Description: "The ARN of a KMS Key to use for encrypting the state",
+				Description: "The ARN of a KMS Key to use for encrypting the state. Requires encrypt",
 				Default:     "",
 			},
 
+			"sse_kms_encryption_context": &schema.Schema{
+				Type:        schema.TypeMap,
+				Optional:    true,
+				Description: "The SSE-KMS encryption context of the state. Requires kms_key_id",
+			},
+
+			"use_bucket_default_encryption": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Encrypt state with the bucket's default encryption, instead of AES256, when encrypt is true. Can't be used with kms_key_id",
+				Default:     false,
+			},
+
 			"lock_table": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -89,6 +191,20 @@ func New() backend.Backend {
 				Default:     "",
 			},
 
+			"dynamodb_key_name": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The name of the partition key of the DynamoDB table",
+				Default:     "LockID",
+			},
+
+			"lock_id": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The key of the lock in the DynamoDB table, instead of bucket/key",
+				Default:     "",
+			},
+
 			"profile": &schema.Schema{
 				Type:        schema.TypeString,
 				Optional:    true,
@@ -116,6 +232,394 @@ func New() backend.Backend {
 				Description: "The role to be assumed",
 				Default:     "",
 			},
+
+			"assume_role_duration_seconds": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "The number of seconds the credentials of role_arn last",
+				Default:      0,
+				ValidateFunc: validation.IntBetween(900, 43200),
+			},
+
+			"serial_number": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The MFA device required to assume role_arn",
+				Default:     "",
+			},
+
+			"token_code": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The code shown by the MFA device in serial_number",
+				Default:     "",
+			},
+
+			"source_role_arn": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A role to assume first, whose credentials are used to assume role_arn",
+				Default:     "",
+			},
+
+			"sts_endpoint": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A custom endpoint for the STS API used to assume roles",
+				DefaultFunc: schema.EnvDefaultFunc("AWS_STS_ENDPOINT", ""),
+			},
+
+			"dynamodb_consistent_read": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use strongly consistent reads of the lock table",
+				Default:     true,
+			},
+
+			"lock_timeout": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Duration to keep retrying to acquire a held lock",
+				Default:      "0s",
+				ValidateFunc: validateDuration,
+			},
+
+			"operation_timeout": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The maximum duration of a state operation, such as reading the state or taking the lock, including retries",
+				Default:      "0s",
+				ValidateFunc: validateDuration,
+			},
+
+			"lock_poll_interval": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Fixed delay between attempts to acquire a held lock, instead of backing off",
+				Default:      "0s",
+				ValidateFunc: validateDuration,
+			},
+
+			"lock_max_attempts": &schema.Schema{
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Description: "The maximum number of attempts to acquire a held lock",
+				Default:     0,
+			},
+
+			"debug_consumed_capacity": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Log the DynamoDB capacity consumed by taking, releasing and reading locks",
+				Default:     false,
+			},
+
+			"lock_ttl": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "Duration after which a lock expires and may be taken over",
+				Default:      "0s",
+				ValidateFunc: validateDuration,
+			},
+
+			"checksum_algorithm": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The checksum algorithm S3 uses to validate uploaded state",
+				Default:      "",
+				ValidateFunc: validation.StringInSlice(checksumAlgorithms, false),
+			},
+
+			"content_type": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The Content-Type of the state object",
+				Default:     "",
+			},
+
+			"metadata": &schema.Schema{
+				Type:         schema.TypeMap,
+				Optional:     true,
+				Description:  "User metadata stored with the state object",
+				ValidateFunc: validateMetadata,
+			},
+
+			"optimistic_locking": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Fail to write state that was changed since it was read",
+				Default:     false,
+			},
+
+			"conflict_retry": &schema.Schema{
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Description: "The number of times a write that conflicts with optimistic_locking is resolved with the conflict handler and retried",
+				Default:     0,
+			},
+
+			"create_only": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Fail to write state if it already exists",
+				Default:     false,
+			},
+
+			"compress": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Compress the state with gzip",
+				Default:     false,
+			},
+
+			"cache_control": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The Cache-Control header stored with the state object",
+				Default:     "no-store",
+			},
+
+			"object_expires": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The Expires header stored with the state object, as an RFC 1123 date or a duration from when it's written",
+				ValidateFunc: validateObjectExpires,
+			},
+
+			"object_lock_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The S3 Object Lock mode of state objects, GOVERNANCE or COMPLIANCE",
+				Default:      "",
+				ValidateFunc: validation.StringInSlice([]string{"GOVERNANCE", "COMPLIANCE"}, false),
+			},
+
+			"object_lock_retain_until_days": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "The number of days state objects are retained by S3 Object Lock",
+				Default:      0,
+				ValidateFunc: validation.IntBetween(1, 36500),
+			},
+
+			"replica_region": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The region of a replica of the bucket to read state from when the bucket can't be read",
+				Default:     "",
+			},
+
+			"replica_bucket": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The name of the replica of the bucket in replica_region",
+				Default:     "",
+			},
+
+			"require_versioning": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Fail unless versioning is enabled on the bucket",
+				Default:     false,
+			},
+
+			"soft_delete": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Move deleted state under the .trash/ prefix instead of deleting it",
+				Default:     false,
+			},
+
+			"soft_delete_retention": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "How long state moved to the trash by soft_delete is kept, forever if empty",
+				Default:      "",
+				ValidateFunc: validateOptionalDuration,
+			},
+
+			"write_backup": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Also write a copy of the state to the state's key with a .backup suffix",
+				Default:     false,
+			},
+
+			"purge_versions": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Delete every version of the state when it is deleted, in a versioned bucket",
+				Default:     false,
+			},
+
+			"min_state_bytes": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "The size in bytes below which state is assumed to be truncated, and isn't uploaded",
+				Default:      0,
+				ValidateFunc: validation.IntBetween(0, math.MaxInt32),
+			},
+
+			"allow_empty": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Upload state smaller than min_state_bytes",
+				Default:     false,
+			},
+
+			"dry_run": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Log state writes and locking instead of making them",
+				Default:     false,
+			},
+
+			"max_retries": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Description:  "The maximum number of times a failed AWS request is retried",
+				Default:      5,
+				ValidateFunc: validation.IntBetween(0, 100),
+			},
+
+			"insecure": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Skip verification of the TLS certificates of the S3 and DynamoDB endpoints",
+				Default:     false,
+			},
+
+			"min_tls_version": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The minimum TLS version of connections to the S3 and DynamoDB endpoints",
+				Default:      "1.2",
+				ValidateFunc: validation.StringInSlice([]string{"1.0", "1.1", "1.2", "1.3"}, false),
+			},
+
+			"ca_bundle": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Path to a PEM file of CA certificates to trust for the S3 and DynamoDB endpoints",
+				Default:     "",
+			},
+
+			"user_agent_suffix": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Text appended to the User-Agent of every S3 and DynamoDB request",
+				Default:     "",
+			},
+
+			"http_client_timeout": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The maximum duration of an S3 or DynamoDB request, including reading the response",
+				Default:      "5m",
+				ValidateFunc: validateDuration,
+			},
+
+			"dial_timeout": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The maximum duration to wait for a connection to S3 or DynamoDB",
+				Default:      "30s",
+				ValidateFunc: validateDuration,
+			},
+
+			"response_header_timeout": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The maximum duration to wait for the response headers after a request has been sent",
+				Default:      "1m",
+				ValidateFunc: validateDuration,
+			},
+
+			"http_proxy": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The URL of a proxy for all S3 and DynamoDB requests",
+				Default:      "",
+				ValidateFunc: validateProxyURL,
+			},
+
+			"use_fips_endpoint": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use the FIPS endpoints of S3 and DynamoDB",
+				Default:     false,
+			},
+
+			"use_dualstack_endpoint": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use the dual-stack (IPv6) S3 endpoint",
+				Default:     false,
+			},
+
+			"force_path_style": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use path-style addressing of the bucket instead of virtual hosts",
+				Default:     false,
+			},
+
+			"accelerate": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Use S3 Transfer Acceleration",
+				Default:     false,
+			},
+
+			"skip_bucket_validation": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Skip checking that the bucket exists in the configured region",
+				Default:     false,
+			},
+
+			"skip_lock_table_check": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Skip checking that lock_table exists and is active",
+				Default:     false,
+			},
+
+			"ec2_metadata_service_endpoint_mode": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Description:  "The EC2 metadata API endpoint to use for instance credentials, IPv4 or IPv6",
+				DefaultFunc:  schema.EnvDefaultFunc("AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE", "IPv4"),
+				ValidateFunc: validation.StringInSlice([]string{"IPv4", "IPv6"}, false),
+			},
+
+			"ec2_metadata_enable_fallback": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Fall back to IMDSv1 when an EC2 metadata session token can't be fetched",
+				Default:     false,
+			},
+
+			"web_identity_token_file": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A file containing an OIDC token to assume role_arn with",
+				Default:     "",
+			},
+
+			"credential_process": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A command that prints credentials as JSON, like credential_process in the AWS config file",
+				Default:     "",
+			},
+
+			"cache_credentials": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Description: "Share resolved credentials with other backends in the process that use the same credential settings",
+				Default:     false,
+			},
 		},
 	}
 
@@ -129,6 +633,15 @@ type Backend struct {
 
 	// The fields below are set from configure
 	client *S3Client
+
+	hooks *Hooks
+
+	// onConflict resolves writes that conflict with optimistic_locking.
+	onConflict ConflictFunc
+
+	// mfaTokenProvider is asked for the MFA code when assuming a role that
+	// requires MFA and no token_code is set.
+	mfaTokenProvider func() (string, error)
 }
 
 func (b *Backend) configure(ctx context.Context) error {
@@ -140,23 +653,166 @@ func (b *Backend) configure(ctx context.Context) error {
 	data := schema.FromContextBackendConfig(ctx)
 
 	bucketName := data.Get("bucket").(string)
-	keyName := data.Get("key").(string)
+	keyName := normalizeKey(data.Get("key").(string))
+	keyTemplate := data.Get("key_template").(string)
+	switch {
+	case keyName != "" && keyTemplate != "":
+		return fmt.Errorf("key and key_template can't be used together")
+	case keyTemplate != "":
+		keyName = renderKeyTemplate(keyTemplate, backend.DefaultStateName)
+	case keyName == "":
+		return fmt.Errorf("One of key or key_template must be set")
+	}
+	workspaceSep := data.Get("workspace_key_separator").(string)
+	if keyTemplate != "" && workspaceSep != "/" {
+		return fmt.Errorf("workspace_key_separator can't be used with key_template")
+	}
 	endpoint := data.Get("endpoint").(string)
 	region := data.Get("region").(string)
 	serverSideEncryption := data.Get("encrypt").(bool)
 	acl := data.Get("acl").(string)
+	if acl != "" && data.Get("skip_acl").(bool) {
+		log.Printf("[DEBUG] Not applying acl %q to S3 state, as skip_acl is set", acl)
+		acl = ""
+	}
 	kmsKeyID := data.Get("kms_key_id").(string)
+	if kmsKeyID != "" && !serverSideEncryption {
+		return fmt.Errorf("kms_key_id is only used when encrypt is true; set encrypt = true to encrypt state with the KMS key")
+	}
+	var kmsEncryptionContext string
+	if v := data.Get("sse_kms_encryption_context").(map[string]interface{}); len(v) > 0 {
+		if kmsKeyID == "" {
+			return fmt.Errorf("sse_kms_encryption_context is only used with SSE-KMS; set kms_key_id and encrypt = true")
+		}
+		var err error
+		kmsEncryptionContext, err = encodeEncryptionContext(v)
+		if err != nil {
+			return fmt.Errorf("Error encoding sse_kms_encryption_context: %s", err)
+		}
+	}
+	bucketEncryption := data.Get("use_bucket_default_encryption").(bool)
+	if bucketEncryption && (!serverSideEncryption || kmsKeyID != "") {
+		return fmt.Errorf("use_bucket_default_encryption requires encrypt = true, and can't be used with kms_key_id")
+	}
 	lockTable := data.Get("lock_table").(string)
+	forcePathStyle := data.Get("force_path_style").(bool)
+	accelerate := data.Get("accelerate").(bool)
+
+	// Accelerated endpoints are only available with virtual host addressing.
+	if accelerate && forcePathStyle {
+		return fmt.Errorf("accelerate cannot be used with force_path_style")
+	}
+
+	if endpoint != "" {
+		warnEndpointPartition(endpoint, region)
+	}
+
+	// Directory buckets are addressed in the path, so the zonal endpoint can
+	// be set from it. They don't support ACLs, and always encrypt objects.
+	directoryZone, isDirectoryBucket := parseDirectoryBucket(bucketName)
+	if isDirectoryBucket {
+		for _, option := range directoryBucketUnsupported {
+			if _, ok := data.GetOk(option); ok {
+				return fmt.Errorf("%s can't be used with the S3 Express One Zone directory bucket %q", option, bucketName)
+			}
+		}
+		if acl != "" {
+			return fmt.Errorf("acl can't be used with the S3 Express One Zone directory bucket %q, which doesn't support ACLs", bucketName)
+		}
+		forcePathStyle = true
+	}
+
+	useFIPS := data.Get("use_fips_endpoint").(bool)
+	if useFIPS && (endpoint != "" || accelerate || data.Get("use_dualstack_endpoint").(bool)) {
+		return fmt.Errorf("use_fips_endpoint cannot be used with endpoint, accelerate or use_dualstack_endpoint")
+	}
+
+	var metadata map[string]*string
+	if v := data.Get("metadata").(map[string]interface{}); len(v) > 0 {
+		metadata = make(map[string]*string, len(v))
+		for k, v := range v {
+			metadata[k] = aws.String(v.(string))
+		}
+	}
+
+	objectLockMode := data.Get("object_lock_mode").(string)
+	objectLockRetainDays := data.Get("object_lock_retain_until_days").(int)
+	if (objectLockMode == "") != (objectLockRetainDays == 0) {
+		return fmt.Errorf("object_lock_mode and object_lock_retain_until_days must be set together")
+	}
+
+	// The durations have already been validated by the schema.
+	lockTimeout, _ := time.ParseDuration(data.Get("lock_timeout").(string))
+	lockTTL, _ := time.ParseDuration(data.Get("lock_ttl").(string))
+	lockPollInterval, _ := time.ParseDuration(data.Get("lock_poll_interval").(string))
+	// An empty soft_delete_retention fails to parse, keeping trashed state
+	// forever.
+	trashRetention, _ := time.ParseDuration(data.Get("soft_delete_retention").(string))
+	operationTimeout, _ := time.ParseDuration(data.Get("operation_timeout").(string))
+
+	softDelete := data.Get("soft_delete").(bool)
+	if softDelete && data.Get("purge_versions").(bool) {
+		return fmt.Errorf("soft_delete and purge_versions can't be used together")
+	}
+
+	// object_expires has been validated by the schema too.
+	expiresAt, expiresAfter, _ := parseObjectExpires(data.Get("object_expires").(string))
+
+	conflictRetries := data.Get("conflict_retry").(int)
+	if conflictRetries < 0 {
+		return fmt.Errorf("conflict_retry must not be negative")
+	}
+	if conflictRetries > 0 && !data.Get("optimistic_locking").(bool) {
+		return fmt.Errorf("conflict_retry requires optimistic_locking")
+	}
+
+	lockMaxAttempts := data.Get("lock_max_attempts").(int)
+	if lockMaxAttempts < 0 {
+		return fmt.Errorf("lock_max_attempts must not be negative")
+	}
+
+	if data.Get("source_role_arn").(string) != "" && data.Get("role_arn").(string) == "" {
+		return fmt.Errorf("source_role_arn requires role_arn")
+	}
+	serialNumber := data.Get("serial_number").(string)
+	if serialNumber != "" && data.Get("token_code").(string) == "" && b.mfaTokenProvider == nil {
+		return fmt.Errorf("serial_number requires token_code, the code shown by the MFA device")
+	}
 
 	var errs []error
-	creds, err := terraformAWS.GetCredentials(&terraformAWS.Config{
+	credsConfig := &terraformAWS.Config{
 		AccessKey:     data.Get("access_key").(string),
 		SecretKey:     data.Get("secret_key").(string),
 		Token:         data.Get("token").(string),
 		Profile:       data.Get("profile").(string),
 		CredsFilename: data.Get("shared_credentials_file").(string),
 		AssumeRoleARN: data.Get("role_arn").(string),
-	})
+
+		AssumeRoleSourceARN: data.Get("source_role_arn").(string),
+		AssumeRoleDuration:  time.Duration(data.Get("assume_role_duration_seconds").(int)) * time.Second,
+
+		AssumeRoleSerialNumber:  serialNumber,
+		AssumeRoleTokenCode:     data.Get("token_code").(string),
+		AssumeRoleTokenProvider: b.mfaTokenProvider,
+
+		Ec2MetadataServiceEndpointMode: data.Get("ec2_metadata_service_endpoint_mode").(string),
+		// Use IMDSv2 session tokens unless falling back is allowed, so
+		// instance credentials work on instances that enforce IMDSv2.
+		Ec2MetadataDisableFallback: !data.Get("ec2_metadata_enable_fallback").(bool),
+		CredentialProcess:          data.Get("credential_process").(string),
+		WebIdentityTokenFile:       data.Get("web_identity_token_file").(string),
+	}
+	if stsEndpoint := data.Get("sts_endpoint").(string); stsEndpoint != "" {
+		// Requests to regional and VPC endpoints are signed for their
+		// region, unlike those to the global endpoint.
+		credsConfig.StsEndpoint = stsEndpoint
+		credsConfig.Region = region
+	}
+	resolveCredentials := getCredentials
+	if data.Get("cache_credentials").(bool) {
+		resolveCredentials = sharedCredentials.get
+	}
+	creds, err := resolveCredentials(credsConfig)
 	if err != nil {
 		return err
 	}
@@ -175,25 +831,433 @@ providing credentials for the AWS S3 remote`))
 		return &multierror.Error{Errors: errs}
 	}
 
+	// The same retry budget is used by the SDK for the requests of the S3
+	// and DynamoDB clients, and by the client's own retries, which turn the
+	// SDK's off for the requests they retry.
+	maxRetries := data.Get("max_retries").(int)
+
 	awsConfig := &aws.Config{
 		Credentials: creds,
 		Endpoint:    aws.String(endpoint),
 		Region:      aws.String(region),
 		HTTPClient:  cleanhttp.DefaultClient(),
+		MaxRetries:  aws.Int(maxRetries),
+	}
+	if useFIPS {
+		awsConfig.EndpointResolver = endpoints.ResolverFunc(fipsResolver)
+	}
+
+	transport := awsConfig.HTTPClient.Transport.(*http.Transport)
+
+	tlsConfig, err := newTLSConfig(data)
+	if err != nil {
+		return err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	// The timeouts have been validated by the schema. Zero disables them.
+	clientTimeout, _ := time.ParseDuration(data.Get("http_client_timeout").(string))
+	dialTimeout, _ := time.ParseDuration(data.Get("dial_timeout").(string))
+	responseHeaderTimeout, _ := time.ParseDuration(data.Get("response_header_timeout").(string))
+	if clientTimeout < 0 || dialTimeout < 0 || responseHeaderTimeout < 0 {
+		return fmt.Errorf("http_client_timeout, dial_timeout and response_header_timeout must not be negative")
 	}
+	awsConfig.HTTPClient.Timeout = clientTimeout
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+
+	// Without an explicit proxy the transport keeps using the proxy from
+	// the environment.
+	if v := data.Get("http_proxy").(string); v != "" {
+		// The URL has already been validated by the schema.
+		proxyURL, _ := url.Parse(v)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
 	sess := session.New(awsConfig)
-	nativeClient := s3.New(sess)
+	if logging.IsDebugOrHigher() {
+		sess.Handlers.UnmarshalMeta.PushBackNamed(logRequest)
+	}
+	if suffix := data.Get("user_agent_suffix").(string); suffix != "" {
+		sess.Handlers.Build.PushBack(func(r *request.Request) {
+			request.AddToUserAgent(r, suffix)
+		})
+	}
+
+	// The endpoint options below only exist for S3, not DynamoDB.
+	nativeClient := s3.New(sess, &aws.Config{
+		UseDualStack:     aws.Bool(data.Get("use_dualstack_endpoint").(bool)),
+		S3ForcePathStyle: aws.Bool(forcePathStyle),
+		S3UseAccelerate:  aws.Bool(accelerate),
+	})
 	dynClient := dynamodb.New(sess)
 
-	b.client = &S3Client{
+	// State is only read from the replica, so it doesn't need the options
+	// for writes below.
+	replicaRegion := data.Get("replica_region").(string)
+	replicaBucket := data.Get("replica_bucket").(string)
+	if (replicaRegion == "") != (replicaBucket == "") {
+		return fmt.Errorf("replica_region and replica_bucket must be set together")
+	}
+	var replicaClient *s3.S3
+	if replicaRegion != "" {
+		replicaClient = s3.New(sess, &aws.Config{
+			Region:           aws.String(replicaRegion),
+			UseDualStack:     aws.Bool(data.Get("use_dualstack_endpoint").(bool)),
+			S3ForcePathStyle: aws.Bool(forcePathStyle),
+		})
+	}
+
+	// Access points have their own endpoints, in the region of the ARN.
+	if ap, ok := parseAccessPointARN(bucketName); ok {
+		if endpoint != "" || forcePathStyle || accelerate || data.Get("use_dualstack_endpoint").(bool) || useFIPS {
+			return fmt.Errorf("An access point ARN can't be used as bucket with endpoint, force_path_style, accelerate, use_dualstack_endpoint or use_fips_endpoint")
+		}
+		nativeClient.Handlers.Build.PushBackNamed(routeToAccessPoint(bucketName, ap))
+	}
+
+	if isDirectoryBucket {
+		express := &expressSession{client: nativeClient, bucket: bucketName}
+		nativeClient.Handlers.Build.PushBackNamed(routeToDirectoryBucket(bucketName, directoryZone))
+		nativeClient.Handlers.Sign.PushFrontNamed(express.signHandler())
+	}
+
+	if owner := data.Get("expected_bucket_owner").(string); owner != "" {
+		nativeClient.Handlers.Build.PushBack(setExpectedBucketOwner(owner))
+		nativeClient.Handlers.UnmarshalError.PushBack(explainExpectedBucketOwner(owner))
+	}
+
+	client := &S3Client{
 		nativeClient:         nativeClient,
 		bucketName:           bucketName,
 		keyName:              keyName,
+		keyTemplate:          keyTemplate,
+		workspaceSep:         workspaceSep,
 		serverSideEncryption: serverSideEncryption,
+		bucketEncryption:     bucketEncryption,
 		acl:                  acl,
 		kmsKeyID:             kmsKeyID,
+		kmsEncryptionContext: kmsEncryptionContext,
 		dynClient:            dynClient,
 		lockTable:            lockTable,
+		lockKeyName:          data.Get("dynamodb_key_name").(string),
+		lockID:               data.Get("lock_id").(string),
+		replicaClient:        replicaClient,
+		replicaBucket:        replicaBucket,
+		dryRun:               data.Get("dry_run").(bool),
+		softDelete:           softDelete,
+		trashRetention:       trashRetention,
+		purgeVersions:        data.Get("purge_versions").(bool),
+		writeBackup:          data.Get("write_backup").(bool),
+		minStateBytes:        data.Get("min_state_bytes").(int),
+		allowEmpty:           data.Get("allow_empty").(bool),
+		hooks:                b.hooks,
+		consistentRead:       data.Get("dynamodb_consistent_read").(bool),
+		lockTimeout:          lockTimeout,
+		operationTimeout:     operationTimeout,
+		lockPollInterval:     lockPollInterval,
+		lockMaxAttempts:      lockMaxAttempts,
+		lockTTL:              lockTTL,
+		checksumAlgorithm:    data.Get("checksum_algorithm").(string),
+		maxRetries:           maxRetries,
+		cacheControl:         data.Get("cache_control").(string),
+		expiresAt:            expiresAt,
+		expiresAfter:         expiresAfter,
+		compress:             data.Get("compress").(bool),
+		contentType:          data.Get("content_type").(string),
+		metadata:             metadata,
+		optimisticLocking:    data.Get("optimistic_locking").(bool),
+		createOnly:           data.Get("create_only").(bool),
+		conflictRetries:      conflictRetries,
+		debugCapacity:        data.Get("debug_consumed_capacity").(bool),
+		onConflict:           b.onConflict,
+		requestPayer:         data.Get("request_payer").(string),
+		objectLockMode:       objectLockMode,
+		objectLockRetainDays: objectLockRetainDays,
+	}
+
+	if data.Get("bootstrap_bucket").(bool) {
+		if _, ok := parseAccessPointARN(bucketName); ok {
+			return fmt.Errorf("bootstrap_bucket can't be used with an access point ARN as bucket")
+		}
+		if err := client.bootstrapBucket(region); err != nil {
+			return err
+		}
+	}
+
+	if !data.Get("skip_bucket_validation").(bool) {
+		if err := client.validateBucket(); err != nil {
+			return err
+		}
+
+		if !serverSideEncryption && !data.Get("skip_encryption_check").(bool) && !isDirectoryBucket {
+			client.warnUnencrypted()
+		}
+	}
+
+	if lockTable != "" && !data.Get("skip_lock_table_check").(bool) {
+		if err := client.checkLockTable(); err != nil {
+			return err
+		}
+	}
+
+	if data.Get("require_versioning").(bool) {
+		if err := client.checkVersioning(); err != nil {
+			return err
+		}
+	}
+
+	if data.Get("manage_bucket_logging").(bool) {
+		target := data.Get("logging_target_bucket").(string)
+		if target == "" {
+			return fmt.Errorf("manage_bucket_logging requires logging_target_bucket")
+		}
+		if err := client.ensureBucketLogging(target, data.Get("logging_target_prefix").(string)); err != nil {
+			return err
+		}
 	}
+
+	b.client = client
 	return nil
 }
+
+// Check verifies that the configured bucket, and lock table if any, can be
+// accessed with the configured credentials, so that missing permissions
+// are reported before any state operation.
+func (b *Backend) Check() error {
+	return b.client.check()
+}
+
+// SetHooks sets the hooks called after each state operation. It can be
+// called before or after the backend is configured.
+func (b *Backend) SetHooks(hooks *Hooks) {
+	b.hooks = hooks
+	if b.client != nil {
+		b.client.hooks = hooks
+	}
+}
+
+// SetConflictHandler sets the function that resolves writes that conflict
+// with optimistic_locking, which are retried up to conflict_retry times. It
+// can be called before or after the backend is configured.
+func (b *Backend) SetConflictHandler(fn ConflictFunc) {
+	b.onConflict = fn
+	if b.client != nil {
+		b.client.onConflict = fn
+	}
+}
+
+// SetMFATokenProvider sets a function that is called for the code of the
+// serial_number MFA device when assuming role_arn, e.g. to prompt for it,
+// instead of configuring token_code. It must be called before the backend
+// is configured.
+func (b *Backend) SetMFATokenProvider(fn func() (string, error)) {
+	b.mfaTokenProvider = fn
+}
+
+// newTLSConfig returns the TLS configuration for the HTTP transport shared by
+// the S3 and DynamoDB clients.
+func newTLSConfig(data *schema.ResourceData) (*tls.Config, error) {
+	insecure := data.Get("insecure").(bool)
+	caBundle := data.Get("ca_bundle").(string)
+
+	// The version has already been validated by the schema.
+	config := &tls.Config{
+		MinVersion: tlsVersions[data.Get("min_tls_version").(string)],
+	}
+
+	if insecure {
+		log.Printf("[WARN] TLS certificate verification is disabled for the S3 backend")
+		config.InsecureSkipVerify = true
+	}
+
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading ca_bundle: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificates found in ca_bundle %q", caBundle)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// tlsVersions are the TLS versions min_tls_version accepts.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": versionTLS13,
+}
+
+// versionTLS13 is tls.VersionTLS13, which needs Go 1.12. Go releases before
+// it don't support TLS 1.3, so requiring it makes connections fail.
+const versionTLS13 = 0x0304
+
+// logRequest logs the request ID and HTTP status of every S3 and DynamoDB
+// response, so failed state operations can be traced on the AWS side.
+var logRequest = request.NamedHandler{
+	Name: "terraform.s3.LogRequestHandler",
+	Fn: func(r *request.Request) {
+		status := 0
+		if r.HTTPResponse != nil {
+			status = r.HTTPResponse.StatusCode
+		}
+		log.Printf("[DEBUG] %s/%s: status %d, request ID %q",
+			r.ClientInfo.ServiceName, r.Operation.Name, status, r.RequestID)
+	},
+}
+
+func validateProxyURL(v interface{}, k string) (ws []string, es []error) {
+	u, err := url.Parse(v.(string))
+	if err != nil {
+		es = append(es, fmt.Errorf("%s: invalid URL: %s", k, err))
+	} else if u.Scheme == "" || u.Host == "" {
+		es = append(es, fmt.Errorf("%s: %q must be an absolute URL, e.g. http://proxy:3128", k, v))
+	}
+	return
+}
+
+// setExpectedBucketOwner returns a Build handler that makes S3 reject
+// requests to a bucket that isn't owned by the given account. The SDK has no
+// field for it.
+func setExpectedBucketOwner(owner string) func(*request.Request) {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Expected-Bucket-Owner", owner)
+	}
+}
+
+// explainExpectedBucketOwner returns an UnmarshalError handler that adds the
+// expected bucket owner to access denied errors, since S3 gives no other
+// reason when the owner doesn't match.
+func explainExpectedBucketOwner(owner string) func(*request.Request) {
+	return func(r *request.Request) {
+		reqErr, ok := r.Error.(awserr.RequestFailure)
+		if !ok || reqErr.StatusCode() != 403 {
+			return
+		}
+
+		msg := fmt.Sprintf("%s (the bucket must be owned by the expected_bucket_owner account %s)",
+			reqErr.Message(), owner)
+		r.Error = awserr.NewRequestFailure(
+			awserr.New(reqErr.Code(), msg, reqErr.OrigErr()), reqErr.StatusCode(), reqErr.RequestID())
+	}
+}
+
+var accountIDRegexp = regexp.MustCompile(`^\d{12}$`)
+
+func validateAccountID(v interface{}, k string) (ws []string, es []error) {
+	if !accountIDRegexp.MatchString(v.(string)) {
+		es = append(es, fmt.Errorf("%s: %q is not a 12 digit AWS account ID", k, v))
+	}
+	return
+}
+
+// metadataKeyRegexp matches the characters allowed in HTTP header names.
+var metadataKeyRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// validateMetadata checks that metadata can be sent as x-amz-meta- headers.
+// S3 only allows printable ASCII in them.
+func validateMetadata(v interface{}, k string) (ws []string, es []error) {
+	for key, value := range v.(map[string]interface{}) {
+		if !metadataKeyRegexp.MatchString(key) {
+			es = append(es, fmt.Errorf("%s: %q is not a valid HTTP header name", k, key))
+		}
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		for _, r := range s {
+			if r < ' ' || r > '~' {
+				es = append(es, fmt.Errorf("%s: the value of %q must be printable ASCII", k, key))
+				break
+			}
+		}
+	}
+	return
+}
+
+// normalizeKey removes leading, trailing and duplicate slashes from a key,
+// which would otherwise end up in the object key and lock path.
+func normalizeKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// validateKey rejects keys that don't name an object once normalized, and
+// keys with ".." segments, which S3 doesn't resolve but people may expect
+// it to.
+func validateKey(v interface{}, k string) (ws []string, es []error) {
+	key := v.(string)
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			es = append(es, fmt.Errorf("%s: %q must not contain \"..\" segments", k, key))
+			return
+		}
+	}
+	if normalizeKey(key) == "" {
+		es = append(es, fmt.Errorf("%s: %q does not name an object", k, key))
+	}
+	return
+}
+
+// validateKeyTemplate rejects templates without the workspace placeholder,
+// which would store every workspace's state in the same object, and templates
+// that don't render to a valid key.
+func validateKeyTemplate(v interface{}, k string) (ws []string, es []error) {
+	tmpl := v.(string)
+	if !strings.Contains(tmpl, workspacePlaceholder) {
+		es = append(es, fmt.Errorf("%s: %q must contain %s", k, tmpl, workspacePlaceholder))
+		return
+	}
+	return validateKey(strings.Replace(tmpl, workspacePlaceholder, backend.DefaultStateName, -1), k)
+}
+
+func validateDuration(v interface{}, k string) (ws []string, es []error) {
+	if _, err := time.ParseDuration(v.(string)); err != nil {
+		es = append(es, fmt.Errorf("%s: invalid duration: %s", k, err))
+	}
+	return
+}
+
+// validateOptionalDuration is validateDuration, also accepting an empty value
+// for no duration.
+func validateOptionalDuration(v interface{}, k string) (ws []string, es []error) {
+	if v.(string) == "" {
+		return
+	}
+	return validateDuration(v, k)
+}
+
+func validateObjectExpires(v interface{}, k string) (ws []string, es []error) {
+	if _, _, err := parseObjectExpires(v.(string)); err != nil {
+		es = append(es, fmt.Errorf("%s: %s", k, err))
+	}
+	return
+}
+
+// parseObjectExpires parses object_expires, which is either an RFC 1123 date
+// or a positive duration from when the state is written. An empty value
+// returns neither.
+func parseObjectExpires(v string) (time.Time, time.Duration, error) {
+	if v == "" {
+		return time.Time{}, 0, nil
+	}
+	if at, err := time.Parse(time.RFC1123, v); err == nil {
+		return at, 0, nil
+	}
+	if after, err := time.ParseDuration(v); err == nil {
+		if after <= 0 {
+			return time.Time{}, 0, fmt.Errorf("duration %q must be positive", v)
+		}
+		return time.Time{}, after, nil
+	}
+	return time.Time{}, 0, fmt.Errorf("%q is neither an RFC 1123 date nor a duration", v)
+}
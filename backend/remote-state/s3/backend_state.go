@@ -1,27 +1,114 @@
 package s3
 
 import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/state"
 	"github.com/hashicorp/terraform/state/remote"
+	"github.com/hashicorp/terraform/terraform"
 )
 
 const (
+	// keyEnvPrefix is the prefix of the keys of workspace states, which are
+	// stored as keyEnvPrefix/name/key, unless another separator than "/" is
+	// set with workspace_key_separator.
 	keyEnvPrefix = "-env:"
 )
 
+// States returns the default state and the named states in the bucket.
 func (b *Backend) States() ([]string, error) {
-	return nil, backend.ErrNamedStatesNotSupported
+	names, err := b.client.workspaceNames(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return append([]string{backend.DefaultStateName}, names...), nil
 }
 
+// DeleteState deletes the named state. The default state can't be deleted.
 func (b *Backend) DeleteState(name string) error {
-	return backend.ErrNamedStatesNotSupported
+	if name == backend.DefaultStateName || name == "" {
+		return fmt.Errorf("can't delete default state")
+	}
+
+	return b.client.workspaceClient(name).Delete()
 }
 
 func (b *Backend) State(name string) (state.State, error) {
-	if name != backend.DefaultStateName {
-		return nil, backend.ErrNamedStatesNotSupported
+	client := b.stateClient(name)
+	stateMgr := &remote.State{Client: client}
+	if name == backend.DefaultStateName {
+		return stateMgr, nil
+	}
+
+	// Named states are only listed once their object exists, so an empty
+	// state is written for a new one, like Consul does. The empty state is
+	// written whatever min_state_bytes is.
+	initClient := *client
+	initClient.allowEmpty = true
+	initMgr := &remote.State{Client: &initClient}
+
+	lockInfo := state.NewLockInfo()
+	lockInfo.Operation = "init"
+	lockID, err := initMgr.Lock(lockInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock state in S3: %s", err)
+	}
+
+	// Local helper function so we can call it multiple places
+	lockUnlock := func(parent error) error {
+		if err := initMgr.Unlock(lockID); err != nil {
+			return fmt.Errorf(strings.TrimSpace(errStateUnlock), lockID, err)
+		}
+		return parent
+	}
+
+	if err := initMgr.RefreshState(); err != nil {
+		return nil, lockUnlock(err)
 	}
+	if v := initMgr.State(); v == nil {
+		if err := initMgr.WriteState(terraform.NewState()); err != nil {
+			return nil, lockUnlock(err)
+		}
+		if err := initMgr.PersistState(); err != nil {
+			return nil, lockUnlock(err)
+		}
+	}
+
+	if err := lockUnlock(nil); err != nil {
+		return nil, err
+	}
+	return stateMgr, nil
+}
+
+// StatePath returns the bucket and key of the named state, as "bucket/key".
+func (b *Backend) StatePath(name string) (string, error) {
+	return b.stateClient(name).StatePath(), nil
+}
 
-	return &remote.State{Client: b.client}, nil
+// LockPath returns the key of the named state's lock in the DynamoDB
+// table.
+func (b *Backend) LockPath(name string) (string, error) {
+	return b.stateClient(name).LockPath(), nil
 }
+
+// stateClient returns the client of the named state.
+func (b *Backend) stateClient(name string) *S3Client {
+	if name == backend.DefaultStateName {
+		return b.client
+	}
+	return b.client.workspaceClient(name)
+}
+
+const errStateUnlock = `
+Error unlocking S3 state. Lock ID: %s
+
+Error: %s
+
+You may have to force-unlock this state in order to use it again.
+`
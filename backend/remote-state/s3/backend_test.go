@@ -1,68 +1,1524 @@
 package s3
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/backend"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/state"
+	"github.com/hashicorp/terraform/terraform"
+
+	terraformAWS "github.com/hashicorp/terraform/builtin/providers/aws"
 )
 
-// verify that we are doing ACC tests or the S3 tests specifically
-func testACC(t *testing.T) {
-	skip := os.Getenv("TF_ACC") == "" && os.Getenv("TF_S3_TEST") == ""
-	if skip {
-		t.Log("s3 backend tests require setting TF_ACC or TF_S3_TEST")
-		t.Skip()
+// verify that we are doing ACC tests or the S3 tests specifically
+func testACC(t *testing.T) {
+	skip := os.Getenv("TF_ACC") == "" && os.Getenv("TF_S3_TEST") == ""
+	if skip {
+		t.Log("s3 backend tests require setting TF_ACC or TF_S3_TEST")
+		t.Skip()
+	}
+	if os.Getenv("AWS_DEFAULT_REGION") == "" {
+		os.Setenv("AWS_DEFAULT_REGION", "us-west-2")
+	}
+}
+
+func TestBackend_impl(t *testing.T) {
+	var _ backend.Backend = new(Backend)
+}
+
+func TestBackendConfig(t *testing.T) {
+	// This test just instantiates the client. Shouldn't make any actual
+	// requests nor incur any costs.
+
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"encrypt":                true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"lock_table":             "dynamoTable",
+		"skip_lock_table_check":  true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	if *b.client.nativeClient.Config.Region != "us-west-1" {
+		t.Fatalf("Incorrect region was populated")
+	}
+	if b.client.bucketName != "tf-test" {
+		t.Fatalf("Incorrect bucketName was populated")
+	}
+	if b.client.keyName != "state" {
+		t.Fatalf("Incorrect keyName was populated")
+	}
+
+	credentials, err := b.client.nativeClient.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("Error when requesting credentials")
+	}
+	if credentials.AccessKeyID != "ACCESS_KEY" {
+		t.Fatalf("Incorrect Access Key Id was populated")
+	}
+	if credentials.SecretAccessKey != "SECRET_KEY" {
+		t.Fatalf("Incorrect Secret Access Key was populated")
+	}
+}
+
+func TestBackendConfig_insecure(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"insecure":               true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	for name, c := range map[string]*aws.Config{
+		"s3":       &b.client.nativeClient.Config,
+		"dynamodb": &b.client.dynClient.Config,
+	} {
+		transport := c.HTTPClient.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil || !transport.TLSClientConfig.InsecureSkipVerify {
+			t.Fatalf("%s: TLS verification was not disabled", name)
+		}
+	}
+}
+
+func TestBackendConfig_minTLSVersion(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  uint16
+	}{
+		{"", tls.VersionTLS12},
+		{"1.0", tls.VersionTLS10},
+		{"1.3", versionTLS13},
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+		if tc.value != "" {
+			config["min_tls_version"] = tc.value
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+		for name, c := range map[string]*aws.Config{
+			"s3":       &b.client.nativeClient.Config,
+			"dynamodb": &b.client.dynClient.Config,
+		} {
+			transport := c.HTTPClient.Transport.(*http.Transport)
+			if transport.TLSClientConfig == nil || transport.TLSClientConfig.MinVersion != tc.want {
+				t.Fatalf("%s: expected minimum TLS version %x, got %#v", name, tc.want, transport.TLSClientConfig)
+			}
+		}
+	}
+}
+
+func TestBackendConfig_invalidMinTLSVersion(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":          "us-west-1",
+		"bucket":          "tf-test",
+		"key":             "state",
+		"min_tls_version": "TLSv1.2",
+		"access_key":      "ACCESS_KEY",
+		"secret_key":      "SECRET_KEY",
+	})
+	if err == nil || !strings.Contains(err.Error(), "min_tls_version") {
+		t.Fatalf("expected an error about min_tls_version, got %v", err)
+	}
+}
+
+func TestBackendConfig_caBundle(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"ca_bundle":              "test-fixtures/ca-bundle.pem",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	for name, c := range map[string]*aws.Config{
+		"s3":       &b.client.nativeClient.Config,
+		"dynamodb": &b.client.dynClient.Config,
+	} {
+		transport := c.HTTPClient.Transport.(*http.Transport)
+		if transport.TLSClientConfig == nil || transport.TLSClientConfig.RootCAs == nil {
+			t.Fatalf("%s: CA bundle was not loaded", name)
+		}
+		if transport.TLSClientConfig.InsecureSkipVerify {
+			t.Fatalf("%s: TLS verification should not be disabled", name)
+		}
+	}
+}
+
+func TestBackendConfig_caBundleInvalid(t *testing.T) {
+	for _, path := range []string{"test-fixtures/missing.pem", "backend_test.go"} {
+		err := testBackendConfigErr(t, map[string]interface{}{
+			"region":     "us-west-1",
+			"bucket":     "tf-test",
+			"key":        "state",
+			"access_key": "ACCESS_KEY",
+			"secret_key": "SECRET_KEY",
+			"ca_bundle":  path,
+		})
+		if err == nil {
+			t.Fatalf("%s: expected an error for an invalid ca_bundle", path)
+		}
+	}
+}
+
+func TestBackendConfig_httpProxy(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"http_proxy":             "http://proxy.example.com:3128",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	req, err := http.NewRequest("GET", "https://s3.amazonaws.com/tf-test/state", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]*aws.Config{
+		"s3":       &b.client.nativeClient.Config,
+		"dynamodb": &b.client.dynClient.Config,
+	} {
+		proxy, err := c.HTTPClient.Transport.(*http.Transport).Proxy(req)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if proxy == nil || proxy.String() != "http://proxy.example.com:3128" {
+			t.Fatalf("%s: request not routed to the proxy: %v", name, proxy)
+		}
+	}
+}
+
+func TestBackendConfig_userAgentSuffix(t *testing.T) {
+	b := backend.TestBackendConfig(t, New(), map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"lock_table":             "tf-lock",
+		"skip_lock_table_check":  true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"user_agent_suffix":      "security-team/1.0",
+	}).(*Backend)
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+	stub.install(b.client.dynClient.Client)
+
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.client.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"PutObject", "PutItem", "DeleteItem"} {
+		ua := stub.requests(op)[0].HTTPRequest.Header.Get("User-Agent")
+		if !strings.HasPrefix(ua, "aws-sdk-go/") || !strings.HasSuffix(ua, " security-team/1.0") {
+			t.Fatalf("%s: expected the suffix on the SDK's User-Agent, got %q", op, ua)
+		}
+	}
+}
+
+func TestBackendConfig_softDeleteWithPurgeVersions(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"soft_delete":            true,
+		"purge_versions":         true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	})
+	if err == nil || !strings.Contains(err.Error(), "soft_delete and purge_versions") {
+		t.Fatalf("expected an error about soft_delete and purge_versions, got %v", err)
+	}
+}
+
+func TestBackendConfig_softDeleteRetention(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"soft_delete":            true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	// Trashed state is kept forever by default.
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if b.client.trashRetention != 0 {
+		t.Fatalf("expected no retention by default, got %s", b.client.trashRetention)
+	}
+
+	config["soft_delete_retention"] = "24h"
+	b = backend.TestBackendConfig(t, New(), config).(*Backend)
+	if b.client.trashRetention != 24*time.Hour {
+		t.Fatalf("expected a retention of 24h, got %s", b.client.trashRetention)
+	}
+
+	config["soft_delete_retention"] = "a month"
+	if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "invalid duration") {
+		t.Fatalf("expected an invalid duration error, got %v", err)
+	}
+}
+
+func TestBackendConfig_httpTimeouts(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	// The defaults aren't infinite.
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	httpClient := b.client.nativeClient.Config.HTTPClient
+	if httpClient.Timeout != 5*time.Minute {
+		t.Fatalf("expected the default client timeout, got %s", httpClient.Timeout)
+	}
+	if got := httpClient.Transport.(*http.Transport).ResponseHeaderTimeout; got != time.Minute {
+		t.Fatalf("expected the default response header timeout, got %s", got)
+	}
+
+	config["http_client_timeout"] = "90s"
+	config["dial_timeout"] = "5s"
+	config["response_header_timeout"] = "20s"
+	b = backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	for name, c := range map[string]*aws.Config{
+		"s3":       &b.client.nativeClient.Config,
+		"dynamodb": &b.client.dynClient.Config,
+	} {
+		if c.HTTPClient.Timeout != 90*time.Second {
+			t.Fatalf("%s: expected a client timeout of 90s, got %s", name, c.HTTPClient.Timeout)
+		}
+		transport := c.HTTPClient.Transport.(*http.Transport)
+		if transport.ResponseHeaderTimeout != 20*time.Second {
+			t.Fatalf("%s: expected a response header timeout of 20s, got %s", name, transport.ResponseHeaderTimeout)
+		}
+		if transport.DialContext == nil {
+			t.Fatalf("%s: expected a dialer with the dial timeout", name)
+		}
+	}
+
+	config["dial_timeout"] = "-1s"
+	if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "must not be negative") {
+		t.Fatalf("expected an error for a negative timeout, got %v", err)
+	}
+}
+
+func TestBackendConfig_responseHeaderTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	b := backend.TestBackendConfig(t, New(), map[string]interface{}{
+		"region":                  "us-west-1",
+		"bucket":                  "tf-test",
+		"key":                     "state",
+		"endpoint":                ts.URL,
+		"force_path_style":        true,
+		"skip_bucket_validation":  true,
+		"access_key":              "ACCESS_KEY",
+		"secret_key":              "SECRET_KEY",
+		"max_retries":             0,
+		"response_header_timeout": "50ms",
+	}).(*Backend)
+
+	start := time.Now()
+	if _, err := b.client.Get(); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("request wasn't stopped by the response header timeout, took %s", elapsed)
+	}
+}
+
+func TestBackendConfig_invalidHTTPProxy(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":     "us-west-1",
+		"bucket":     "tf-test",
+		"key":        "state",
+		"http_proxy": "proxy.example.com",
+	})
+	if err == nil {
+		t.Fatal("expected an error for a relative http_proxy")
+	}
+}
+
+func TestBackendConfig_dualStack(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"use_dualstack_endpoint": true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	if !aws.BoolValue(b.client.nativeClient.Config.UseDualStack) {
+		t.Fatal("UseDualStack was not set on the S3 client")
+	}
+	if e := b.client.nativeClient.Endpoint; e != "https://s3.dualstack.us-west-1.amazonaws.com" {
+		t.Fatalf("bad S3 endpoint: %s", e)
+	}
+}
+
+func TestBackendConfig_fips(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-2",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"lock_table":             "tf-lock",
+		"skip_lock_table_check":  true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"use_fips_endpoint":      true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	if e := b.client.nativeClient.Endpoint; e != "https://s3-fips.us-west-2.amazonaws.com" {
+		t.Fatalf("bad S3 endpoint: %s", e)
+	}
+	if e := b.client.dynClient.Endpoint; e != "https://dynamodb-fips.us-west-2.amazonaws.com" {
+		t.Fatalf("bad DynamoDB endpoint: %s", e)
+	}
+	if r := b.client.nativeClient.SigningRegion; r != "us-west-2" {
+		t.Fatalf("bad signing region: %s", r)
+	}
+
+	config["endpoint"] = "http://localhost:9000"
+	err := testBackendConfigErr(t, config)
+	if err == nil || !strings.Contains(err.Error(), "use_fips_endpoint") {
+		t.Fatalf("expected an error about use_fips_endpoint, got %v", err)
+	}
+}
+
+func TestBackendConfig_accelerate(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"accelerate":             true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	if !aws.BoolValue(b.client.nativeClient.Config.S3UseAccelerate) {
+		t.Fatal("S3UseAccelerate was not set on the S3 client")
+	}
+}
+
+func TestBackendConfig_accelerateWithPathStyle(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":           "us-west-1",
+		"bucket":           "tf-test",
+		"key":              "state",
+		"access_key":       "ACCESS_KEY",
+		"secret_key":       "SECRET_KEY",
+		"accelerate":       true,
+		"force_path_style": true,
+	})
+	if err == nil {
+		t.Fatal("expected an error for accelerate with force_path_style")
+	}
+}
+
+func TestBackendConfig_ec2MetadataToken(t *testing.T) {
+	var tokenRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			atomic.AddInt32(&tokenRequests, 1)
+			fmt.Fprint(w, "test-token")
+			return
+		}
+
+		// Behave like an instance that enforces IMDSv2.
+		if r.Header.Get("X-aws-ec2-metadata-token") != "test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/latest/meta-data/instance-id":
+			fmt.Fprint(w, "i-0123456789abcdef0")
+		case "/latest/meta-data/iam/security-credentials":
+			fmt.Fprint(w, "test_role")
+		case "/latest/meta-data/iam/security-credentials/test_role":
+			fmt.Fprint(w, `{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"metadatakey","SecretAccessKey":"metadatasecret","Token":"metadatatoken"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	defer testSetEnv(t, map[string]string{
+		"AWS_METADATA_URL":            ts.URL + "/latest",
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_ACCESS_KEY":              "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SECRET_KEY":              "",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+		"AWS_SHARED_CREDENTIALS_FILE": "test-fixtures/missing-credentials",
+	})()
+
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	credentials, err := b.client.nativeClient.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal("Error when requesting credentials:", err)
+	}
+	if credentials.AccessKeyID != "metadatakey" {
+		t.Fatalf("Incorrect Access Key Id was populated: %q", credentials.AccessKeyID)
+	}
+	if atomic.LoadInt32(&tokenRequests) == 0 {
+		t.Fatal("No IMDSv2 token was requested")
+	}
+}
+
+func TestBackendConfig_ec2MetadataEnableFallback(t *testing.T) {
+	// An instance that only serves IMDSv1.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/meta-data/instance-id":
+			fmt.Fprint(w, "i-0123456789abcdef0")
+		case "/latest/meta-data/iam/security-credentials":
+			fmt.Fprint(w, "test_role")
+		case "/latest/meta-data/iam/security-credentials/test_role":
+			fmt.Fprint(w, `{"Code":"Success","Type":"AWS-HMAC","AccessKeyId":"metadatakey","SecretAccessKey":"metadatasecret","Token":"metadatatoken"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	defer testSetEnv(t, map[string]string{
+		"AWS_METADATA_URL":            ts.URL + "/latest",
+		"AWS_ACCESS_KEY_ID":           "",
+		"AWS_ACCESS_KEY":              "",
+		"AWS_SECRET_ACCESS_KEY":       "",
+		"AWS_SECRET_KEY":              "",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_PROFILE":                 "",
+		"AWS_SHARED_CREDENTIALS_FILE": "test-fixtures/missing-credentials",
+	})()
+
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+	}
+
+	// Without a token, instance credentials aren't used by default.
+	err := testBackendConfigErr(t, config)
+	if err == nil || !strings.Contains(err.Error(), "No valid credential sources") {
+		t.Fatalf("expected instance credentials to require a token, got %v", err)
+	}
+
+	config["ec2_metadata_enable_fallback"] = true
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	credentials, err := b.client.nativeClient.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal("Error when requesting credentials:", err)
+	}
+	if credentials.AccessKeyID != "metadatakey" {
+		t.Fatalf("Incorrect Access Key Id was populated: %q", credentials.AccessKeyID)
+	}
+}
+
+func TestBackendConfig_credentialProcess(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the credential process fixture requires sh")
+	}
+
+	defer testSetEnv(t, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "envkey",
+		"AWS_SECRET_ACCESS_KEY": "envsecret",
+	})()
+
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"credential_process":     "test-fixtures/credential-process.sh",
+		"skip_bucket_validation": true,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	for _, creds := range []*credentials.Credentials{
+		b.client.nativeClient.Config.Credentials,
+		b.client.dynClient.Config.Credentials,
+	} {
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatal("Error when requesting credentials:", err)
+		}
+		if v.AccessKeyID != "processkey" {
+			t.Fatalf("Incorrect Access Key Id was populated: %q", v.AccessKeyID)
+		}
+		if v.SessionToken != "processtoken" {
+			t.Fatalf("Incorrect Session Token was populated: %q", v.SessionToken)
+		}
+	}
+}
+
+func TestBackendConfig_webIdentityTokenFile(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                  "us-west-1",
+		"bucket":                  "tf-test",
+		"key":                     "state",
+		"role_arn":                "arn:aws:iam::123456789012:role/web-identity",
+		"web_identity_token_file": "test-fixtures/missing-token",
+		"skip_bucket_validation":  true,
+	}
+
+	// The missing token file shows the web identity provider was used,
+	// without making a request to STS.
+	err := testBackendConfigErr(t, config)
+	if err == nil || !strings.Contains(err.Error(), "web identity token file") {
+		t.Fatalf("expected a web identity token file error, got: %v", err)
+	}
+
+	delete(config, "role_arn")
+	err = testBackendConfigErr(t, config)
+	if err == nil || !strings.Contains(err.Error(), "role ARN is required") {
+		t.Fatalf("expected a missing role error, got: %v", err)
+	}
+}
+
+func TestBackendConfig_logRequests(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	for _, level := range []string{"", "DEBUG"} {
+		restore := testSetEnv(t, map[string]string{"TF_LOG": level})
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		restore()
+
+		// Removing the handler only changes the list if it was registered.
+		for _, h := range []*request.HandlerList{
+			&b.client.nativeClient.Handlers.UnmarshalMeta,
+			&b.client.dynClient.Handlers.UnmarshalMeta,
+		} {
+			n := h.Len()
+			h.Remove(logRequest)
+			if registered := h.Len() != n; registered != (level != "") {
+				t.Fatalf("TF_LOG=%q: request logging registered: %t", level, registered)
+			}
+		}
+	}
+}
+
+func TestBackendConfig_sourceRoleWithoutRole(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"source_role_arn":        "arn:aws:iam::123456789012:role/jump",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	})
+	if err == nil || !strings.Contains(err.Error(), "requires role_arn") {
+		t.Fatalf("expected an error about role_arn, got %v", err)
+	}
+}
+
+func TestBackendConfig_invalidAssumeRoleDuration(t *testing.T) {
+	for _, seconds := range []int{60, 43201} {
+		err := testBackendConfigErr(t, map[string]interface{}{
+			"region":                       "us-west-1",
+			"bucket":                       "tf-test",
+			"key":                          "state",
+			"role_arn":                     "arn:aws:iam::123456789012:role/target",
+			"assume_role_duration_seconds": seconds,
+		})
+		if err == nil {
+			t.Fatalf("%d: expected an error", seconds)
+		}
+	}
+}
+
+func TestBackendConfig_serialNumberWithoutTokenCode(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"role_arn":               "arn:aws:iam::123456789012:role/target",
+		"serial_number":          "arn:aws:iam::123456789012:mfa/user",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	})
+	if err == nil || !strings.Contains(err.Error(), "token_code") {
+		t.Fatalf("expected an error about token_code, got %v", err)
+	}
+}
+
+func TestBackendConfig_maxRetries(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  int
+	}{
+		{nil, 5},
+		{2, 2},
+		{0, 0},
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"lock_table":             "tf-lock",
+			"skip_lock_table_check":  true,
+			"replica_region":         "us-east-1",
+			"replica_bucket":         "tf-test-replica",
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+		if tc.value != nil {
+			config["max_retries"] = tc.value
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		if b.client.maxRetries != tc.want {
+			t.Fatalf("expected %d retries, got %d", tc.want, b.client.maxRetries)
+		}
+		for name, c := range map[string]*client.Client{
+			"S3":       b.client.nativeClient.Client,
+			"DynamoDB": b.client.dynClient.Client,
+			"replica":  b.client.replicaClient.Client,
+		} {
+			if got := aws.IntValue(c.Config.MaxRetries); got != tc.want {
+				t.Fatalf("expected %d retries in the %s client config, got %d", tc.want, name, got)
+			}
+			if got := c.MaxRetries(); got != tc.want {
+				t.Fatalf("expected %d retries by the %s client, got %d", tc.want, name, got)
+			}
+		}
+	}
+}
+
+func TestBackendConfig_manageBucketLoggingWithoutTarget(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"manage_bucket_logging":  true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	})
+	if err == nil || !strings.Contains(err.Error(), "logging_target_bucket") {
+		t.Fatalf("expected an error about logging_target_bucket, got %v", err)
+	}
+}
+
+func TestBackendConfig_cacheControl(t *testing.T) {
+	for _, tc := range []struct {
+		value, want string
+	}{
+		{"", "no-store"},
+		{"private, max-age=0", "private, max-age=0"},
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+		if tc.value != "" {
+			config["cache_control"] = tc.value
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		stub := newStubAWS()
+		stub.install(b.client.nativeClient.Client)
+
+		if err := b.client.Put([]byte("test state")); err != nil {
+			t.Fatal(err)
+		}
+		in := stub.requests("PutObject")[0].Params.(*s3.PutObjectInput)
+		if got := aws.StringValue(in.CacheControl); got != tc.want {
+			t.Fatalf("expected Cache-Control %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestBackendConfig_objectExpires(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  func(time.Time) bool
+	}{
+		{"", nil},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", func(got time.Time) bool {
+			return got.Equal(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC))
+		}},
+		{"24h", func(got time.Time) bool {
+			d := got.Sub(time.Now())
+			return d > 23*time.Hour && d <= 24*time.Hour
+		}},
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+		if tc.value != "" {
+			config["object_expires"] = tc.value
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		stub := newStubAWS()
+		stub.install(b.client.nativeClient.Client)
+
+		if err := b.client.Put([]byte("test state")); err != nil {
+			t.Fatal(err)
+		}
+		r := stub.requests("PutObject")[0]
+		header := r.HTTPRequest.Header.Get("Expires")
+		if tc.want == nil {
+			if header != "" {
+				t.Fatalf("expected no Expires header, got %q", header)
+			}
+			continue
+		}
+
+		got, err := time.Parse(rest.RFC822, header)
+		if err != nil {
+			t.Fatalf("%s: bad Expires header %q: %s", tc.value, header, err)
+		}
+		if !tc.want(got) {
+			t.Fatalf("%s: unexpected Expires header %q", tc.value, header)
+		}
+	}
+}
+
+func TestBackendConfig_invalidObjectExpires(t *testing.T) {
+	for _, v := range []string{"tomorrow", "-1h", "2006-01-02"} {
+		err := testBackendConfigErr(t, map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"object_expires":         v,
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		})
+		if err == nil || !strings.Contains(err.Error(), "object_expires") {
+			t.Fatalf("%s: expected an error about object_expires, got %v", v, err)
+		}
+	}
+}
+
+func TestBackendConfig_skipACL(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+			"acl":                    "bucket-owner-full-control",
+			"skip_acl":               skip,
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		stub := newStubAWS()
+		stub.install(b.client.nativeClient.Client)
+
+		if err := b.client.Put([]byte("test state")); err != nil {
+			t.Fatal(err)
+		}
+		in := stub.requests("PutObject")[0].Params.(*s3.PutObjectInput)
+		if sent := in.ACL != nil; sent == skip {
+			t.Fatalf("skip_acl = %t, but ACL sent: %t", skip, sent)
+		}
+	}
+}
+
+func TestBackendConfig_consistentRead(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		want  bool
+	}{
+		{nil, true},
+		{false, false},
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"lock_table":             "tf-lock",
+			"skip_lock_table_check":  true,
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+		if tc.value != nil {
+			config["dynamodb_consistent_read"] = tc.value
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		stub := newStubAWS()
+		stub.install(b.client.dynClient.Client)
+
+		if _, err := b.client.Lock(state.NewLockInfo()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.client.getLockInfo(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		in := stub.requests("GetItem")[0].Params.(*dynamodb.GetItemInput)
+		if got := aws.BoolValue(in.ConsistentRead); got != tc.want {
+			t.Fatalf("expected ConsistentRead %t, got %t", tc.want, got)
+		}
+	}
+}
+
+func TestBackendConfig_metadata(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"metadata": map[string]interface{}{
+			"ci-job": "1234",
+		},
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if v := aws.StringValue(b.client.metadata["ci-job"]); v != "1234" {
+		t.Fatalf("bad metadata: %#v", b.client.metadata)
+	}
+
+	for _, metadata := range []map[string]interface{}{
+		{"ci job": "1234"},
+		{"ci-job": "caf\u00e9"},
+		{"ci-job": "line\nbreak"},
+	} {
+		config["metadata"] = metadata
+		if err := testBackendConfigErr(t, config); err == nil {
+			t.Fatalf("expected an error for metadata %q", metadata)
+		}
+	}
+}
+
+func TestBackendConfig_expectedBucketOwner(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"expected_bucket_owner":  "123456789012",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.client.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"PutObject", "GetObject", "DeleteObject"} {
+		r := stub.requests(op)[0]
+		if owner := r.HTTPRequest.Header.Get("X-Amz-Expected-Bucket-Owner"); owner != "123456789012" {
+			t.Fatalf("%s: bad expected bucket owner header: %q", op, owner)
+		}
+	}
+
+	config["expected_bucket_owner"] = "1234"
+	if err := testBackendConfigErr(t, config); err == nil {
+		t.Fatal("expected an error for an invalid account ID")
+	}
+}
+
+func TestExplainExpectedBucketOwner(t *testing.T) {
+	r := &request.Request{
+		Error: awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "request-id"),
 	}
-	if os.Getenv("AWS_DEFAULT_REGION") == "" {
-		os.Setenv("AWS_DEFAULT_REGION", "us-west-2")
+	explainExpectedBucketOwner("123456789012")(r)
+
+	reqErr, ok := r.Error.(awserr.RequestFailure)
+	if !ok || reqErr.Code() != "AccessDenied" || reqErr.StatusCode() != 403 {
+		t.Fatalf("error lost its type: %#v", r.Error)
+	}
+	if !strings.Contains(reqErr.Message(), "expected_bucket_owner account 123456789012") {
+		t.Fatalf("error doesn't explain the expected owner: %s", reqErr)
 	}
 }
 
-func TestBackend_impl(t *testing.T) {
-	var _ backend.Backend = new(Backend)
+func TestBackendConfig_objectLock(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                        "us-west-1",
+		"bucket":                        "tf-test",
+		"key":                           "state",
+		"skip_bucket_validation":        true,
+		"access_key":                    "ACCESS_KEY",
+		"secret_key":                    "SECRET_KEY",
+		"object_lock_mode":              "GOVERNANCE",
+		"object_lock_retain_until_days": 7,
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if b.client.objectLockMode != "GOVERNANCE" || b.client.objectLockRetainDays != 7 {
+		t.Fatalf("bad object lock settings: %q, %d", b.client.objectLockMode, b.client.objectLockRetainDays)
+	}
+
+	delete(config, "object_lock_retain_until_days")
+	if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("expected an error for object_lock_mode alone, got: %v", err)
+	}
+
+	delete(config, "object_lock_mode")
+	config["object_lock_retain_until_days"] = 7
+	if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("expected an error for object_lock_retain_until_days alone, got: %v", err)
+	}
+
+	config["object_lock_mode"] = "LEGAL_HOLD"
+	if err := testBackendConfigErr(t, config); err == nil {
+		t.Fatal("expected an error for an invalid object_lock_mode")
+	}
 }
 
-func TestBackendConfig(t *testing.T) {
-	// This test just instantiates the client. Shouldn't make any actual
-	// requests nor incur any costs.
+func TestBackendConfig_invalidChecksumAlgorithm(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":             "us-west-1",
+		"bucket":             "tf-test",
+		"key":                "state",
+		"checksum_algorithm": "MD4",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported checksum_algorithm")
+	}
+}
+
+func TestBackendCheck(t *testing.T) {
+	stub := newStubAWS()
+	b := &Backend{client: stub.client()}
+
+	if err := b.Check(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
 
+	stub.handlers["DescribeTable"] = func(r *request.Request) {
+		stubError(r, 400, "AccessDeniedException")
+	}
+	err := b.Check()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), `DynamoDB table "tf-lock"`) || !strings.Contains(err.Error(), "dynamodb:DescribeTable") {
+		t.Fatalf("error doesn't describe the lock table permission: %s", err)
+	}
+
+	stub.handlers["HeadBucket"] = func(r *request.Request) {
+		stubError(r, 403, "Forbidden")
+	}
+	err = b.Check()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if errs := err.(*multierror.Error).Errors; len(errs) != 2 {
+		t.Fatalf("expected errors for the bucket and table, got: %s", err)
+	}
+	if !strings.Contains(err.Error(), "s3:ListBucket") {
+		t.Fatalf("error doesn't describe the bucket permission: %s", err)
+	}
+}
+
+func TestBackendConfig_dynamoDBKeyName(t *testing.T) {
 	config := map[string]interface{}{
-		"region":     "us-west-1",
-		"bucket":     "tf-test",
-		"key":        "state",
-		"encrypt":    true,
-		"access_key": "ACCESS_KEY",
-		"secret_key": "SECRET_KEY",
-		"lock_table": "dynamoTable",
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"lock_table":             "tf-lock",
+		"skip_lock_table_check":  true,
+		"dynamodb_key_name":      "lock_path",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
 	}
 
 	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.keyName = "lock_path"
+	stub.install(b.client.dynClient.Client)
 
-	if *b.client.nativeClient.Config.Region != "us-west-1" {
-		t.Fatalf("Incorrect region was populated")
+	info := state.NewLockInfo()
+	info.Operation = "test"
+	id, err := b.client.Lock(info)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if b.client.bucketName != "tf-test" {
-		t.Fatalf("Incorrect bucketName was populated")
+	item, ok := stub.items["tf-test/state"]
+	if !ok {
+		t.Fatal("lock wasn't stored under the custom key")
 	}
-	if b.client.keyName != "state" {
-		t.Fatalf("Incorrect keyName was populated")
+	if _, ok := item["LockID"]; ok {
+		t.Fatal("lock has a LockID attribute")
 	}
 
-	credentials, err := b.client.nativeClient.Config.Credentials.Get()
+	in := stub.requests("PutItem")[0].Params.(*dynamodb.PutItemInput)
+	if got := aws.StringValue(in.ExpressionAttributeNames["#key"]); got != "lock_path" {
+		t.Fatalf("expected the condition on lock_path, got %q", got)
+	}
+
+	lockInfo, err := b.client.getLockInfo(context.Background())
 	if err != nil {
-		t.Fatalf("Error when requesting credentials")
+		t.Fatal(err)
 	}
-	if credentials.AccessKeyID != "ACCESS_KEY" {
-		t.Fatalf("Incorrect Access Key Id was populated")
+	if lockInfo.ID != id {
+		t.Fatalf("expected lock ID %q, got %q", id, lockInfo.ID)
 	}
-	if credentials.SecretAccessKey != "SECRET_KEY" {
-		t.Fatalf("Incorrect Secret Access Key was populated")
+
+	if err := b.client.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.items) != 0 {
+		t.Fatalf("lock wasn't deleted: %#v", stub.items)
+	}
+}
+
+func TestBackendConfig_lockID(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"lock_table":             "tf-lock",
+		"skip_lock_table_check":  true,
+		"lock_id":                "network",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+	stub.install(b.client.dynClient.Client)
+
+	if path, err := b.LockPath(backend.DefaultStateName); err != nil || path != "network" {
+		t.Fatalf("expected lock path %q, got %q (%v)", "network", path, err)
+	}
+
+	info := state.NewLockInfo()
+	info.Operation = "test"
+	id, err := b.client.Lock(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.items["network"]; !ok {
+		t.Fatalf("lock wasn't stored under the lock ID: %#v", stub.items)
+	}
+
+	// Moving the state doesn't move its lock.
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Move("renamed", false); err != nil {
+		t.Fatal(err)
+	}
+
+	lockInfo, err := b.client.getLockInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockInfo.ID != id {
+		t.Fatalf("expected lock ID %q, got %q", id, lockInfo.ID)
+	}
+
+	if err := b.client.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if locks := stub.locks(); len(locks) != 0 {
+		t.Fatalf("lock wasn't deleted: %#v", locks)
+	}
+}
+
+func TestBackendConfig_key(t *testing.T) {
+	for _, tc := range []struct {
+		key, want string
+	}{
+		{"state", "state"},
+		{"/state", "state"},
+		{"path/to/state/", "path/to/state"},
+		{"path//to///state", "path/to/state"},
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    tc.key,
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+
+		b := backend.TestBackendConfig(t, New(), config).(*Backend)
+		if b.client.keyName != tc.want {
+			t.Fatalf("%q: expected key %q, got %q", tc.key, tc.want, b.client.keyName)
+		}
+		if got := b.client.StatePath(); got != "tf-test/"+tc.want {
+			t.Fatalf("%q: expected state path %q, got %q", tc.key, "tf-test/"+tc.want, got)
+		}
+	}
+}
+
+func TestBackendConfig_invalidKey(t *testing.T) {
+	for _, key := range []string{"../state", "path/../state", "/", "//"} {
+		err := testBackendConfigErr(t, map[string]interface{}{
+			"region": "us-west-1",
+			"bucket": "tf-test",
+			"key":    key,
+		})
+		if err == nil {
+			t.Fatalf("%q: expected an error", key)
+		}
+	}
+}
+
+func TestBackendConfig_dryRun(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"lock_table":             "tf-lock",
+		"skip_lock_table_check":  true,
+		"dry_run":                true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.objects["state"] = []byte("existing state")
+	stub.install(b.client.nativeClient.Client)
+	stub.install(b.client.dynClient.Client)
+
+	id, err := b.client.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == "" {
+		t.Fatal("expected a lock ID")
+	}
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Move("moved", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"PutObject", "CopyObject", "DeleteObject", "PutItem", "DeleteItem"} {
+		if n := len(stub.requests(op)); n != 0 {
+			t.Fatalf("expected no %s calls, got %d", op, n)
+		}
+	}
+
+	// Reads still go to S3.
+	payload, err := b.client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload.Data) != "existing state" {
+		t.Fatalf("unexpected state: %q", payload.Data)
+	}
+}
+
+func TestBackendConfig_replica(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"replica_region":         "us-east-1",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+	if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("expected an error about replica_bucket, got %v", err)
+	}
+
+	config["replica_bucket"] = "tf-test-replica"
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if got := aws.StringValue(b.client.replicaClient.Config.Region); got != "us-east-1" {
+		t.Fatalf("expected the replica client in us-east-1, got %q", got)
+	}
+	if b.client.replicaBucket != "tf-test-replica" {
+		t.Fatalf("expected replica bucket %q, got %q", "tf-test-replica", b.client.replicaBucket)
+	}
+}
+
+func TestBackendHooks(t *testing.T) {
+	stub := newStubAWS()
+	b := &Backend{client: stub.client()}
+
+	durations := make(map[string]time.Duration)
+	errs := make(map[string]error)
+	hook := func(op string) func(time.Duration, error) {
+		return func(d time.Duration, err error) {
+			durations[op] = d
+			errs[op] = err
+		}
+	}
+	b.SetHooks(&Hooks{
+		OnGet:    hook("get"),
+		OnPut:    hook("put"),
+		OnDelete: hook("delete"),
+		OnLock:   hook("lock"),
+		OnUnlock: hook("unlock"),
+	})
+
+	// Slow down the requests, so the durations can be checked.
+	stub.handlers["PutObject"] = func(r *request.Request) {
+		time.Sleep(10 * time.Millisecond)
+		stub.serve(r)
+	}
+	stub.handlers["GetObject"] = func(r *request.Request) {
+		time.Sleep(10 * time.Millisecond)
+		stubError(r, http.StatusInternalServerError, "InternalError")
+	}
+
+	id, err := b.client.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.client.Get(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := b.client.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []string{"get", "put", "delete", "lock", "unlock"} {
+		d, ok := durations[op]
+		if !ok {
+			t.Fatalf("%s hook wasn't called", op)
+		}
+		if d <= 0 || d > time.Minute {
+			t.Fatalf("implausible %s duration %s", op, d)
+		}
+	}
+	for _, op := range []string{"put", "get"} {
+		if durations[op] < 10*time.Millisecond {
+			t.Fatalf("expected a %s duration of at least 10ms, got %s", op, durations[op])
+		}
+	}
+	if errs["get"] == nil {
+		t.Fatal("expected the get hook to see the error")
+	}
+	if errs["put"] != nil {
+		t.Fatalf("unexpected put error: %s", errs["put"])
+	}
+}
+
+func TestBackendConfig_kmsKeyWithoutEncrypt(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"kms_key_id":             "arn:aws:kms:us-west-1:123456789012:key/test",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+	err := testBackendConfigErr(t, config)
+	if err == nil || !strings.Contains(err.Error(), "encrypt") {
+		t.Fatalf("expected an error about encrypt, got %v", err)
+	}
+
+	config["encrypt"] = false
+	if err := testBackendConfigErr(t, config); err == nil {
+		t.Fatal("expected an error with encrypt = false")
+	}
+
+	config["encrypt"] = true
+	if err := testBackendConfigErr(t, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendPaths(t *testing.T) {
+	b := &Backend{client: newStubAWS().client()}
+
+	statePath, err := b.StatePath(backend.DefaultStateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statePath != "tf-test/state" {
+		t.Fatalf("expected state path %q, got %q", "tf-test/state", statePath)
+	}
+
+	lockPath, err := b.LockPath(backend.DefaultStateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockPath != "tf-test/state" {
+		t.Fatalf("expected lock path %q, got %q", "tf-test/state", lockPath)
+	}
+
+	// Named states are stored under the workspace prefix.
+	statePath, err = b.StatePath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statePath != "tf-test/-env:/foo/state" {
+		t.Fatalf("expected state path %q, got %q", "tf-test/-env:/foo/state", statePath)
+	}
+	lockPath, err = b.LockPath("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockPath != "tf-test/-env:/foo/state" {
+		t.Fatalf("expected lock path %q, got %q", "tf-test/-env:/foo/state", lockPath)
+	}
+}
+
+func TestBackendStates(t *testing.T) {
+	backend.TestBackend(t, &Backend{client: newStubAWS().client()}, nil)
+
+	// A new named state is listed before anything is written to it, even
+	// when small state isn't uploaded.
+	stub := newStubAWS()
+	b := &Backend{client: stub.client()}
+	b.client.minStateBytes = 1 << 20
+	if _, err := b.State("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.objects["-env:/dev/state"]; !ok {
+		t.Fatalf("no state was written for the new workspace: %v", stub.objects)
+	}
+	states, err := b.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"default", "dev"}; !reflect.DeepEqual(states, want) {
+		t.Fatalf("expected states %q, got %q", want, states)
+	}
+	if _, ok := stub.items["tf-test/-env:/dev/state"]; ok {
+		t.Fatal("the lock taken to write the new state wasn't released")
+	}
+
+	// The state of an existing workspace is left alone.
+	stub.calls = nil
+	if _, err := b.State("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.requests("PutObject")); n != 0 {
+		t.Fatalf("existing state was overwritten, %d PutObject calls", n)
 	}
 }
 
@@ -73,9 +1529,10 @@ func TestBackend(t *testing.T) {
 	keyName := "testState"
 
 	b := backend.TestBackendConfig(t, New(), map[string]interface{}{
-		"bucket":  bucketName,
-		"key":     keyName,
-		"encrypt": true,
+		"bucket":                 bucketName,
+		"key":                    keyName,
+		"skip_bucket_validation": true,
+		"encrypt":                true,
 	}).(*Backend)
 
 	createS3Bucket(t, b.client, bucketName)
@@ -91,17 +1548,21 @@ func TestBackendLocked(t *testing.T) {
 	keyName := "testState"
 
 	b1 := backend.TestBackendConfig(t, New(), map[string]interface{}{
-		"bucket":     bucketName,
-		"key":        keyName,
-		"encrypt":    true,
-		"lock_table": bucketName,
+		"bucket":                 bucketName,
+		"key":                    keyName,
+		"skip_bucket_validation": true,
+		"encrypt":                true,
+		"lock_table":             bucketName,
+		"skip_lock_table_check":  true,
 	}).(*Backend)
 
 	b2 := backend.TestBackendConfig(t, New(), map[string]interface{}{
-		"bucket":     bucketName,
-		"key":        keyName,
-		"encrypt":    true,
-		"lock_table": bucketName,
+		"bucket":                 bucketName,
+		"key":                    keyName,
+		"skip_bucket_validation": true,
+		"encrypt":                true,
+		"lock_table":             bucketName,
+		"skip_lock_table_check":  true,
 	}).(*Backend)
 
 	createS3Bucket(t, b1.client, bucketName)
@@ -112,6 +1573,93 @@ func TestBackendLocked(t *testing.T) {
 	backend.TestBackend(t, b1, b2)
 }
 
+// testSetEnv sets the given environment variables, unsetting those with an
+// empty value, and returns a function that restores the previous values.
+func testSetEnv(t *testing.T, env map[string]string) func() {
+	old := make(map[string]*string)
+	for k, v := range env {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+
+		var err error
+		if v == "" {
+			err = os.Unsetenv(k)
+		} else {
+			err = os.Setenv(k, v)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestBackendConfig_stsEndpoint(t *testing.T) {
+	var got *terraformAWS.Config
+	oldGet := getCredentials
+	defer func() { getCredentials = oldGet }()
+	getCredentials = func(c *terraformAWS.Config) (*credentials.Credentials, error) {
+		got = c
+		return credentials.NewStaticCredentials("ROLE_KEY", "ROLE_SECRET", ""), nil
+	}
+
+	backend.TestBackendConfig(t, New(), map[string]interface{}{
+		"region":                 "eu-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"role_arn":               "arn:aws:iam::123456789012:role/a",
+		"sts_endpoint":           "https://vpce-123.sts.eu-west-1.vpce.amazonaws.com",
+		"skip_bucket_validation": true,
+	})
+
+	if got.StsEndpoint != "https://vpce-123.sts.eu-west-1.vpce.amazonaws.com" {
+		t.Fatalf("expected the STS endpoint to be used to assume the role, got %q", got.StsEndpoint)
+	}
+	if got.Region != "eu-west-1" {
+		t.Fatalf("expected STS requests to be signed for eu-west-1, got %q", got.Region)
+	}
+}
+
+func TestBackendConfig_conflictRetryRequiresOptimisticLocking(t *testing.T) {
+	err := testBackendConfigErr(t, map[string]interface{}{
+		"region":         "us-west-1",
+		"bucket":         "tf-test",
+		"key":            "state",
+		"conflict_retry": 1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "conflict_retry requires optimistic_locking") {
+		t.Fatalf("expected an error, got %v", err)
+	}
+}
+
+// testBackendConfigErr validates and configures a new S3 backend like
+// backend.TestBackendConfig, but returns the error rather than failing.
+func testBackendConfigErr(t *testing.T, c map[string]interface{}) error {
+	rc, err := config.NewRawConfig(c)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	conf := terraform.NewResourceConfig(rc)
+
+	b := New()
+	if _, errs := b.Validate(conf); len(errs) > 0 {
+		return &multierror.Error{Errors: errs}
+	}
+	return b.Configure(conf)
+}
+
 func createS3Bucket(t *testing.T, c *S3Client, bucketName string) {
 	createBucketReq := &s3.CreateBucketInput{
 		Bucket: &bucketName,
@@ -142,13 +1690,13 @@ func createDynamoDBTable(t *testing.T, c *S3Client, tableName string) {
 	createInput := &dynamodb.CreateTableInput{
 		AttributeDefinitions: []*dynamodb.AttributeDefinition{
 			{
-				AttributeName: aws.String("LockID"),
+				AttributeName: aws.String(c.lockKeyName),
 				AttributeType: aws.String("S"),
 			},
 		},
 		KeySchema: []*dynamodb.KeySchemaElement{
 			{
-				AttributeName: aws.String("LockID"),
+				AttributeName: aws.String(c.lockKeyName),
 				KeyType:       aws.String("HASH"),
 			},
 		},
@@ -164,31 +1712,9 @@ func createDynamoDBTable(t *testing.T, c *S3Client, tableName string) {
 		t.Fatal(err)
 	}
 
-	// now wait until it's ACTIVE
-	start := time.Now()
-	time.Sleep(time.Second)
-
-	describeInput := &dynamodb.DescribeTableInput{
-		TableName: aws.String(tableName),
-	}
-
-	for {
-		resp, err := c.dynClient.DescribeTable(describeInput)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if *resp.Table.TableStatus == "ACTIVE" {
-			return
-		}
-
-		if time.Since(start) > time.Minute {
-			t.Fatalf("timed out creating DynamoDB table %s", tableName)
-		}
-
-		time.Sleep(3 * time.Second)
+	if err := c.waitForTableActive(context.Background(), tableName, time.Minute); err != nil {
+		t.Fatal(err)
 	}
-
 }
 
 func deleteDynamoDBTable(t *testing.T, c *S3Client, tableName string) {
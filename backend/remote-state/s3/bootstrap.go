@@ -0,0 +1,158 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The vendored SDK predates default bucket encryption and public access
+// blocks, so the operations that configure them are defined here.
+
+const (
+	opPutBucketEncryption  = "PutBucketEncryption"
+	opPutPublicAccessBlock = "PutPublicAccessBlock"
+)
+
+type putBucketEncryptionInput struct {
+	_ struct{} `type:"structure" payload:"ServerSideEncryptionConfiguration"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+
+	ServerSideEncryptionConfiguration *serverSideEncryptionConfiguration `locationName:"ServerSideEncryptionConfiguration" type:"structure" required:"true"`
+}
+
+type putPublicAccessBlockInput struct {
+	_ struct{} `type:"structure" payload:"PublicAccessBlockConfiguration"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+
+	PublicAccessBlockConfiguration *publicAccessBlockConfiguration `locationName:"PublicAccessBlockConfiguration" type:"structure" required:"true"`
+}
+
+type publicAccessBlockConfiguration struct {
+	_ struct{} `type:"structure"`
+
+	BlockPublicAcls       *bool `locationName:"BlockPublicAcls" type:"boolean"`
+	BlockPublicPolicy     *bool `locationName:"BlockPublicPolicy" type:"boolean"`
+	IgnorePublicAcls      *bool `locationName:"IgnorePublicAcls" type:"boolean"`
+	RestrictPublicBuckets *bool `locationName:"RestrictPublicBuckets" type:"boolean"`
+}
+
+type putBucketConfigurationOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// bootstrapBucket creates the bucket in region if it doesn't exist yet, with
+// versioning, default encryption and all public access blocked, so that it
+// is ready to store state. An existing bucket is left unchanged.
+func (c *S3Client) bootstrapBucket(region string) error {
+	_, err := c.nativeClient.HeadBucket(&s3.HeadBucketInput{
+		Bucket: &c.bucketName,
+	})
+	if err == nil {
+		log.Printf("[DEBUG] S3 bucket %q already exists, not bootstrapping it", c.bucketName)
+		return nil
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != 404 {
+		return fmt.Errorf("Error checking for S3 bucket %q: %s", c.bucketName, err)
+	}
+
+	log.Printf("[INFO] Creating S3 bucket %q in region %q", c.bucketName, region)
+	input := &s3.CreateBucketInput{
+		Bucket: &c.bucketName,
+	}
+	// Buckets in us-east-1 must be created without a location constraint.
+	if region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+	if _, err := c.nativeClient.CreateBucket(input); err != nil {
+		// Someone else may have created it in the meantime.
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != s3.ErrCodeBucketAlreadyOwnedByYou {
+			return fmt.Errorf("Error creating S3 bucket %q: %s", c.bucketName, err)
+		}
+	}
+
+	_, err = c.nativeClient.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: &c.bucketName,
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error enabling versioning of S3 bucket %q: %s", c.bucketName, err)
+	}
+
+	byDefault := &serverSideEncryptionByDefault{SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256)}
+	if c.kmsKeyID != "" {
+		byDefault = &serverSideEncryptionByDefault{
+			SSEAlgorithm:   aws.String(s3.ServerSideEncryptionAwsKms),
+			KMSMasterKeyID: aws.String(c.kmsKeyID),
+		}
+	}
+	err = c.putBucketConfiguration(opPutBucketEncryption, "/{Bucket}?encryption", &putBucketEncryptionInput{
+		Bucket: &c.bucketName,
+		ServerSideEncryptionConfiguration: &serverSideEncryptionConfiguration{
+			Rules: []*serverSideEncryptionRule{{ApplyServerSideEncryptionByDefault: byDefault}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error enabling default encryption of S3 bucket %q: %s", c.bucketName, err)
+	}
+
+	err = c.putBucketConfiguration(opPutPublicAccessBlock, "/{Bucket}?publicAccessBlock", &putPublicAccessBlockInput{
+		Bucket: &c.bucketName,
+		PublicAccessBlockConfiguration: &publicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error blocking public access to S3 bucket %q: %s", c.bucketName, err)
+	}
+
+	return nil
+}
+
+// putBucketConfiguration sends one of the bucket configuration operations
+// defined above.
+func (c *S3Client) putBucketConfiguration(name, path string, input interface{}) error {
+	req := c.nativeClient.NewRequest(&request.Operation{
+		Name:       name,
+		HTTPMethod: "PUT",
+		HTTPPath:   path,
+	}, input, &putBucketConfigurationOutput{})
+	req.Handlers.Build.PushBack(setBodyMD5)
+	return req.Send()
+}
+
+// setBodyMD5 is a Build handler that sets the Content-MD5 header from the
+// request body, which S3 requires for bucket configuration requests. The SDK
+// only does so for the operations it knows.
+func setBodyMD5(r *request.Request) {
+	if r.Error != nil || r.Body == nil {
+		return
+	}
+
+	h := md5.New()
+	if _, err := io.Copy(h, r.Body); err != nil {
+		r.Error = err
+		return
+	}
+	if _, err := r.Body.Seek(0, io.SeekStart); err != nil {
+		r.Error = err
+		return
+	}
+	r.HTTPRequest.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
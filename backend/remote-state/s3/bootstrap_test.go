@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRemoteClientBootstrapBucket(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.bucketName = "tf-test-new"
+
+	created := false
+	stub.handlers["HeadBucket"] = func(r *request.Request) {
+		if !created {
+			stubError(r, 404, "NotFound")
+		}
+	}
+	stub.handlers["CreateBucket"] = func(r *request.Request) { created = true }
+	bodies := map[string]string{}
+	for _, op := range []string{"PutBucketVersioning", "PutBucketEncryption", "PutPublicAccessBlock"} {
+		stub.handlers[op] = func(r *request.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			// The SDK doesn't send the optional Content-MD5 of
+			// PutBucketVersioning.
+			if r.Operation.Name != "PutBucketVersioning" {
+				sum := md5.Sum(body)
+				if got, want := r.HTTPRequest.Header.Get("Content-Md5"), base64.StdEncoding.EncodeToString(sum[:]); got != want {
+					t.Errorf("%s: expected Content-MD5 %q, got %q", r.Operation.Name, want, got)
+				}
+			}
+			bodies[r.Operation.Name] = string(body)
+		}
+	}
+
+	if err := c.bootstrapBucket("eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := stub.requests("CreateBucket")
+	if len(reqs) != 1 {
+		t.Fatalf("expected the bucket to be created once, got %d CreateBucket calls", len(reqs))
+	}
+	in := reqs[0].Params.(*s3.CreateBucketInput)
+	if aws.StringValue(in.Bucket) != "tf-test-new" || in.CreateBucketConfiguration == nil ||
+		aws.StringValue(in.CreateBucketConfiguration.LocationConstraint) != "eu-west-1" {
+		t.Fatalf("bad CreateBucket input: %#v", in)
+	}
+
+	for op, want := range map[string][]string{
+		"PutBucketVersioning": {"<Status>Enabled</Status>"},
+		"PutBucketEncryption": {
+			"<ServerSideEncryptionConfiguration>",
+			"<Rule><ApplyServerSideEncryptionByDefault><SSEAlgorithm>AES256</SSEAlgorithm></ApplyServerSideEncryptionByDefault></Rule>",
+		},
+		"PutPublicAccessBlock": {
+			"<BlockPublicAcls>true</BlockPublicAcls>",
+			"<BlockPublicPolicy>true</BlockPublicPolicy>",
+			"<IgnorePublicAcls>true</IgnorePublicAcls>",
+			"<RestrictPublicBuckets>true</RestrictPublicBuckets>",
+		},
+	} {
+		for _, w := range want {
+			if !strings.Contains(bodies[op], w) {
+				t.Fatalf("%s: expected %s in the body, got %s", op, w, bodies[op])
+			}
+		}
+	}
+	if q := stub.requests("PutPublicAccessBlock")[0].HTTPRequest.URL.Query(); q["publicAccessBlock"] == nil {
+		t.Fatalf("bad PutPublicAccessBlock query: %v", q)
+	}
+
+	// Running it again leaves the existing bucket alone.
+	stub.calls = nil
+	if err := c.bootstrapBucket("eu-west-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.calls) != 1 {
+		t.Fatalf("expected only the bucket to be checked, got %d calls", len(stub.calls))
+	}
+}
+
+func TestRemoteClientBootstrapBucketUSEast1KMS(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.kmsKeyID = "arn:aws:kms:us-east-1:123456789012:key/test"
+	c.nativeClient.Config.Region = aws.String("us-east-1")
+
+	stub.handlers["HeadBucket"] = func(r *request.Request) {
+		stubError(r, 404, "NotFound")
+	}
+	var encryption string
+	for _, op := range []string{"CreateBucket", "PutBucketVersioning", "PutBucketEncryption", "PutPublicAccessBlock"} {
+		stub.handlers[op] = func(r *request.Request) {
+			if r.Operation.Name == "PutBucketEncryption" {
+				body, _ := ioutil.ReadAll(r.Body)
+				encryption = string(body)
+			}
+		}
+	}
+
+	if err := c.bootstrapBucket("us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	in := stub.requests("CreateBucket")[0].Params.(*s3.CreateBucketInput)
+	if in.CreateBucketConfiguration != nil {
+		t.Fatalf("expected no location constraint in us-east-1, got %#v", in.CreateBucketConfiguration)
+	}
+	if !strings.Contains(encryption, "<KMSMasterKeyID>arn:aws:kms:us-east-1:123456789012:key/test</KMSMasterKeyID>") ||
+		!strings.Contains(encryption, "<SSEAlgorithm>aws:kms</SSEAlgorithm>") {
+		t.Fatalf("expected encryption with the KMS key, got %s", encryption)
+	}
+}
@@ -2,13 +2,29 @@ package s3
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
 	multierror "github.com/hashicorp/go-multierror"
@@ -26,94 +42,1372 @@ type S3Client struct {
 	kmsKeyID             string
 	dynClient            *dynamodb.DynamoDB
 	lockTable            string
+
+	// bucketEncryption leaves encryption to the bucket's default
+	// encryption when serverSideEncryption is set, so that state is
+	// encrypted with the bucket's KMS key instead of AES256.
+	bucketEncryption bool
+
+	// kmsEncryptionContext is the base64 encoded JSON SSE-KMS encryption
+	// context of written state, for key policies that require one.
+	kmsEncryptionContext string
+
+	// keyTemplate is the layout of the keys of workspace states set with
+	// key_template, from which keyName, the key of the default workspace,
+	// was rendered.
+	keyTemplate string
+
+	// workspaceSep joins the workspace prefix, the workspace name and
+	// keyName in the keys of workspace states, set with
+	// workspace_key_separator.
+	workspaceSep string
+
+	// debugCapacity makes lock table requests return the capacity
+	// they consumed, which is logged.
+	debugCapacity bool
+
+	// lockKeyName is the name of the lock table's partition key, which
+	// holds the lock path.
+	lockKeyName string
+
+	// lockID is the key of the state's lock in the lock table, instead of
+	// the state path, so the lock doesn't depend on the bucket and key.
+	lockID string
+
+	// consistentRead makes lock info reads strongly consistent, so they
+	// see a lock that was only just acquired.
+	consistentRead bool
+
+	// lockTimeout is how long Lock keeps retrying while the lock is held
+	// by someone else. Zero means fail immediately.
+	lockTimeout time.Duration
+
+	// lockPollInterval is the fixed delay between attempts to acquire a
+	// held lock. Zero means backing off exponentially.
+	lockPollInterval time.Duration
+
+	// lockMaxAttempts limits the number of attempts to acquire a held
+	// lock. Zero means no limit other than lockTimeout. Without a
+	// lockTimeout, Lock keeps trying until the attempts are used up.
+	lockMaxAttempts int
+
+	// lockTTL is how long a lock is valid. Once it has expired, Lock takes
+	// it over from its holder, which may have crashed. Zero means locks
+	// never expire.
+	lockTTL time.Duration
+
+	// checksumAlgorithm selects the additional integrity checksum S3
+	// validates on upload, instead of relying on MD5 alone.
+	checksumAlgorithm string
+
+	// operationTimeout limits how long a state operation, such as Get or
+	// Lock, can take in total, including retries. Zero means no limit.
+	operationTimeout time.Duration
+
+	// maxRetries is the number of times a failed request, or a batch with
+	// unprocessed items, is retried. Requests retried by retry aren't also
+	// retried by the SDK; the SDK clients use the same MaxRetries for the
+	// rest.
+	maxRetries int
+
+	// cacheControl is the Cache-Control header stored with the state, so
+	// caches in front of the bucket don't serve stale state.
+	cacheControl string
+
+	// expiresAt, or expiresAfter from the time of writing, is the Expires
+	// header stored with the state object, for lifecycle tooling.
+	expiresAt    time.Time
+	expiresAfter time.Duration
+
+	// objectLockMode and objectLockRetainDays set the S3 Object Lock
+	// retention of every state object written.
+	objectLockMode       string
+	objectLockRetainDays int
+
+	// compress gzips state before uploading it. Compressed state is
+	// recognized by its Content-Encoding, so it is read correctly either
+	// way.
+	compress bool
+
+	// contentType overrides the Content-Type of the state object, which is
+	// application/json, or application/gzip when compressed.
+	contentType string
+
+	// metadata is stored as user metadata with the state object.
+	metadata map[string]*string
+
+	// optimisticLocking makes Put fail instead of overwriting state that
+	// was changed since it was last read, by sending the ETag that Get saw
+	// as an If-Match precondition.
+	optimisticLocking bool
+	// etag is the ETag of the state object when it was last read or
+	// written.
+	etag string
+
+	// conflictRetries is how many times Put resolves a conflict with
+	// optimistic locking by calling onConflict and writing its result.
+	// Without onConflict conflicts aren't retried.
+	conflictRetries int
+	onConflict      ConflictFunc
+
+	// createOnly makes Put fail instead of overwriting existing state, by
+	// sending an If-None-Match precondition.
+	createOnly bool
+
+	// requestPayer is set to "requester" to access a Requester Pays
+	// bucket.
+	requestPayer string
+
+	// replicaClient and replicaBucket read the state from a replica of the
+	// bucket, such as a cross-region replication destination, when the
+	// bucket can't be read. They are nil and empty without a replica.
+	replicaClient *s3.S3
+	replicaBucket string
+
+	// softDelete makes Delete move the state under trashPrefix instead of
+	// deleting it. Trashed state older than trashRetention is deleted when
+	// more state is trashed. Zero keeps it forever.
+	softDelete     bool
+	trashRetention time.Duration
+
+	// purgeVersions makes Delete delete every version of the state in a
+	// versioned bucket, instead of adding a delete marker.
+	purgeVersions bool
+
+	// writeBackup makes Put also copy the state to backupKey.
+	writeBackup bool
+
+	// minStateBytes is the smallest state Put uploads, to guard against
+	// overwriting state with truncated state. allowEmpty disables the
+	// check.
+	minStateBytes int
+	allowEmpty    bool
+
+	// hooks are called after each operation, if set.
+	hooks *Hooks
+
+	// dryRun makes Put, Delete, Move, Lock and Unlock log what they would do
+	// instead of doing it. Get still reads the state.
+	dryRun bool
+}
+
+const (
+	// States larger than multipartThreshold bytes are uploaded in parts of
+	// multipartPartSize bytes. S3 requires parts of at least 5MB.
+	multipartThreshold = 16 << 20
+	multipartPartSize  = 8 << 20
+
+	// Bounds for the delay between attempts to acquire a held lock.
+	lockRetryMinDelay = 500 * time.Millisecond
+	lockRetryMaxDelay = 16 * time.Second
+
+	// lockInfoTimeout bounds reading who holds a lock after failing to
+	// acquire it.
+	lockInfoTimeout = 10 * time.Second
+)
+
+func (c *S3Client) Get() (*remote.Payload, error) {
+	return c.GetWithContext(context.Background())
+}
+
+// GetWithContext is Get, stopping when ctx is done.
+func (c *S3Client) GetWithContext(ctx context.Context) (*remote.Payload, error) {
+	payload, _, err := c.GetWithInfo(ctx)
+	return payload, err
+}
+
+// ObjectInfo describes the state object that was read, to help tell which
+// run wrote it.
+type ObjectInfo struct {
+	LastModified time.Time
+	// ContentLength is the size of the object, which is smaller than the
+	// state when it's compressed.
+	ContentLength int64
+	ETag          string
+}
+
+// GetWithInfo is GetWithContext, also returning information about the state
+// object. The info is nil when there is no state.
+func (c *S3Client) GetWithInfo(ctx context.Context) (payload *remote.Payload, info *ObjectInfo, err error) {
+	if c.hooks != nil && c.hooks.OnGet != nil {
+		defer observe(c.hooks.OnGet, time.Now(), &err)
+	}
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "read", &err)
+
+	return c.get(ctx, "")
+}
+
+// GetVersion reads the given version of the state object in a versioned
+// bucket, e.g. to recover state that was overwritten. Get always reads the
+// current version.
+func (c *S3Client) GetVersion(versionID string) (*remote.Payload, error) {
+	return c.GetVersionWithContext(context.Background(), versionID)
+}
+
+// GetVersionWithContext is GetVersion, stopping when ctx is done.
+func (c *S3Client) GetVersionWithContext(ctx context.Context, versionID string) (payload *remote.Payload, err error) {
+	if versionID == "" {
+		return nil, fmt.Errorf("A version ID is required to read a version of the state")
+	}
+	if c.hooks != nil && c.hooks.OnGet != nil {
+		defer observe(c.hooks.OnGet, time.Now(), &err)
+	}
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "read", &err)
+
+	payload, _, err = c.get(ctx, versionID)
+	return payload, err
+}
+
+// get reads the state object, or the given version of it. Only the current
+// version is read from the replica, whose version IDs differ, and is
+// remembered for optimistic locking.
+func (c *S3Client) get(ctx context.Context, versionID string) (*remote.Payload, *ObjectInfo, error) {
+	output, s3Sum, err := c.getObject(ctx, c.nativeClient, c.bucketName, versionID)
+	if err != nil && versionID == "" && c.replicaClient != nil && isReplicaFallback(err) {
+		log.Printf("[WARN] Failed to read state from bucket %q, reading the replica in bucket %q: %s",
+			c.bucketName, c.replicaBucket, err)
+		output, s3Sum, err = c.getObject(ctx, c.replicaClient, c.replicaBucket, "")
+	}
+
+	if err != nil {
+		awsErr, _ := err.(awserr.Error)
+		if versionID != "" && awsErr != nil && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NoSuchVersion") {
+			return nil, nil, fmt.Errorf("Version %q of state %s doesn't exist", versionID, c.StatePath())
+		}
+		// A missing object means the state was never written.
+		if awsErr != nil && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			c.etag = ""
+			return nil, nil, nil
+		}
+		if isCustomerKeyRequired(err) {
+			return nil, nil, fmt.Errorf(strings.TrimSpace(errCustomerKeyRequired), err)
+		}
+		return nil, nil, classifyAction(err, "s3:GetObject", c.StatePath())
+	}
+
+	defer output.Body.Close()
+	info := &ObjectInfo{
+		LastModified:  aws.TimeValue(output.LastModified),
+		ContentLength: aws.Int64Value(output.ContentLength),
+		ETag:          aws.StringValue(output.ETag),
+	}
+	if versionID == "" {
+		c.etag = info.ETag
+	}
+
+	data, err := readBody(output.Body, aws.Int64Value(output.ContentLength))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read remote state: %s", err)
+	}
+
+	if c.verifiesChecksum() {
+		if err := c.verifyChecksum(ctx, data, s3Sum, versionID == ""); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if aws.StringValue(output.ContentEncoding) == "gzip" {
+		data, err = gunzip(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to decompress remote state: %s", err)
+		}
+	}
+
+	// An empty object is returned as an empty payload rather than nil, so
+	// it can be told apart from a missing one. It usually means the state
+	// was truncated.
+	if len(data) == 0 {
+		log.Printf("[WARN] S3 state object %q in bucket %q is empty", c.keyName, c.bucketName)
+	}
+
+	return &remote.Payload{
+		Data:     data,
+		Metadata: aws.StringValueMap(output.Metadata),
+	}, info, nil
+}
+
+// ConflictFunc resolves a write of state that failed because the state was
+// changed since it was read. It's called with the state now in S3, which is
+// nil if there is none, and the state that wasn't written, and returns the
+// state to write instead, such as the two merged.
+type ConflictFunc func(current, ours []byte) ([]byte, error)
+
+// Hooks are called with the duration and result of each state operation,
+// e.g. to record metrics. Any of them may be nil.
+type Hooks struct {
+	OnGet    func(time.Duration, error)
+	OnPut    func(time.Duration, error)
+	OnDelete func(time.Duration, error)
+	OnLock   func(time.Duration, error)
+	OnUnlock func(time.Duration, error)
+}
+
+// observe calls hook with the time since start and the error err points to.
+// It's deferred, so that it sees the operation's final error.
+func observe(hook func(time.Duration, error), start time.Time, err *error) {
+	hook(time.Since(start), *err)
+}
+
+// getObject reads the state object from bucket, or the given version of it if
+// versionID isn't empty. When checksums are verified, it also returns the
+// SHA256 checksum S3 stored with the object, if any.
+func (c *S3Client) getObject(ctx context.Context, client *s3.S3, bucket, versionID string) (*s3.GetObjectOutput, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          &c.keyName,
+		RequestPayer: c.requestPayerValue(),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	var output *s3.GetObjectOutput
+	var sum string
+	err := c.retry(ctx, func() error {
+		var req *request.Request
+		req, output = client.GetObjectRequest(input)
+		if c.verifiesChecksum() {
+			req.Handlers.Build.PushBack(enableChecksumMode)
+		}
+		if err := sendOnce(ctx, req); err != nil {
+			return err
+		}
+		sum = req.HTTPResponse.Header.Get(headerChecksumSHA256)
+		return nil
+	})
+	return output, sum, err
+}
+
+// isCustomerKeyRequired reports whether a read failed because the object is
+// encrypted with a customer provided key (SSE-C), which must be sent to read
+// it.
+func isCustomerKeyRequired(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok || reqErr.StatusCode() != 400 || reqErr.Code() != "InvalidRequest" {
+		return false
+	}
+	msg := strings.ToLower(reqErr.Message())
+	return strings.Contains(msg, "customer key") || strings.Contains(msg, "server side encryption")
+}
+
+// replicaFallbackCodes are the errors, besides server errors, that mean the
+// bucket's region can't be reached.
+var replicaFallbackCodes = map[string]bool{
+	"RequestError":      true, // The request couldn't be sent.
+	"RequestTimeout":    true,
+	"PermanentRedirect": true,
+}
+
+// isReplicaFallback reports whether a failed read should be retried against
+// the replica.
+func isReplicaFallback(err error) bool {
+	if isTransient(err) {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return replicaFallbackCodes[awsErr.Code()]
+	}
+	return false
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// requestPayerValue returns the RequestPayer of object requests, or nil for
+// buckets that aren't Requester Pays.
+func (c *S3Client) requestPayerValue() *string {
+	if c.requestPayer == "" {
+		return nil
+	}
+	return aws.String(c.requestPayer)
+}
+
+// readBody reads a whole object body. When the size is known the body is read
+// into a single allocation of exactly that size, rather than into a growing
+// buffer that can briefly need twice the memory of a large state.
+//
+// The data is handed to the caller as the payload and kept by it, so a pooled
+// buffer could only be reused by copying the data out of it again. The
+// vendored SDK has no s3manager Downloader, whose ranged parts would have to
+// be assembled into a buffer of the same size anyway.
+func readBody(body io.Reader, size int64) ([]byte, error) {
+	if size <= 0 {
+		return ioutil.ReadAll(body)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Exists reports whether the state object exists, without reading it.
+func (c *S3Client) Exists() (bool, error) {
+	return c.ExistsWithContext(context.Background())
+}
+
+// ExistsWithContext is Exists, stopping when ctx is done.
+func (c *S3Client) ExistsWithContext(ctx context.Context) (exists bool, err error) {
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "check", &err)
+
+	err = c.retry(ctx, func() error {
+		req, _ := c.nativeClient.HeadObjectRequest(&s3.HeadObjectInput{
+			Bucket:       &c.bucketName,
+			Key:          &c.keyName,
+			RequestPayer: c.requestPayerValue(),
+		})
+		return sendOnce(ctx, req)
+	})
+	if err != nil {
+		// HEAD responses have no body, so a missing object is only told
+		// apart by its status.
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, classifyAction(err, "s3:GetObject", c.StatePath())
+	}
+	return true, nil
+}
+
+func (c *S3Client) Put(data []byte) error {
+	return c.PutWithContext(context.Background(), data)
+}
+
+// PutWithContext is Put, stopping when ctx is done.
+func (c *S3Client) PutWithContext(ctx context.Context, data []byte) (err error) {
+	if c.hooks != nil && c.hooks.OnPut != nil {
+		defer observe(c.hooks.OnPut, time.Now(), &err)
+	}
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "write", &err)
+
+	err = c.put(ctx, data)
+	for attempt := 0; attempt < c.conflictRetries && c.onConflict != nil && isError(err, ErrStateConflict); attempt++ {
+		log.Printf("[INFO] State %s was changed since it was read, resolving the conflict: %s", c.StatePath(), err)
+
+		// Reading the state again also updates the ETag the next write
+		// is conditional on.
+		current, _, getErr := c.get(ctx, "")
+		if getErr != nil {
+			return fmt.Errorf("Error reading state %s to resolve a conflicting write: %s", c.StatePath(), getErr)
+		}
+		var currentData []byte
+		if current != nil {
+			currentData = current.Data
+		}
+
+		data, err = c.onConflict(currentData, data)
+		if err != nil {
+			return fmt.Errorf("Error resolving conflicting write of state %s: %s", c.StatePath(), err)
+		}
+		err = c.put(ctx, data)
+	}
+	return err
+}
+
+// put writes data as the state.
+func (c *S3Client) put(ctx context.Context, data []byte) (err error) {
+	if len(data) < c.minStateBytes && !c.allowEmpty {
+		return fmt.Errorf(strings.TrimSpace(errStateTooSmall), len(data), c.minStateBytes)
+	}
+
+	if c.dryRun {
+		log.Printf("[INFO] Dry run: would upload %d bytes of state to %s (encrypt: %t, KMS key: %q, ACL: %q)",
+			len(data), c.StatePath(), c.serverSideEncryption, c.kmsKeyID, c.acl)
+		return nil
+	}
+
+	var contentEncoding *string
+	if c.compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("Failed to compress state: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("Failed to compress state: %s", err)
+		}
+
+		log.Printf("[DEBUG] Compressed state from %d to %d bytes", len(data), buf.Len())
+		data = buf.Bytes()
+		contentEncoding = aws.String("gzip")
+	}
+
+	contentType := c.contentType
+	if contentType == "" {
+		contentType = "application/json"
+		if c.compress {
+			contentType = "application/gzip"
+		}
+	}
+	contentLength := int64(len(data))
+
+	i := &s3.PutObjectInput{
+		ContentType:     &contentType,
+		ContentEncoding: contentEncoding,
+		ContentLength:   &contentLength,
+		Body:            bytes.NewReader(data),
+		Bucket:          &c.bucketName,
+		Key:             &c.keyName,
+		Metadata:        c.metadata,
+		RequestPayer:    c.requestPayerValue(),
+	}
+
+	if c.serverSideEncryption && !c.bucketEncryption {
+		if c.kmsKeyID != "" {
+			i.SSEKMSKeyId = &c.kmsKeyID
+			i.ServerSideEncryption = aws.String("aws:kms")
+		} else {
+			i.ServerSideEncryption = aws.String("AES256")
+		}
+	}
+
+	if c.acl != "" {
+		i.ACL = aws.String(c.acl)
+	}
+
+	if c.cacheControl != "" {
+		i.CacheControl = aws.String(c.cacheControl)
+	}
+
+	switch {
+	case !c.expiresAt.IsZero():
+		i.Expires = aws.Time(c.expiresAt)
+	case c.expiresAfter > 0:
+		i.Expires = aws.Time(time.Now().Add(c.expiresAfter))
+	}
+
+	if len(data) > multipartThreshold {
+		log.Printf("[DEBUG] Uploading remote state to S3 in parts: %#v", i)
+		if err := c.putMultipart(ctx, i, data); err != nil {
+			return c.uploadError(err)
+		}
+		c.putBackup(ctx)
+		return c.storeDigest(ctx, data)
+	}
+
+	log.Printf("[DEBUG] Uploading remote state to S3: %#v", i)
+
+	var setSum func(*request.Request)
+	if c.checksumAlgorithm != "" {
+		header, sum, err := checksum(c.checksumAlgorithm, data)
+		if err != nil {
+			return err
+		}
+		setSum = c.setChecksum(header, sum)
+	}
+
+	// Writing the whole object again is safe after a network error. With
+	// optimistic locking, a retry of a write that did complete fails as a
+	// conflict, rather than overwriting anything.
+	var output *s3.PutObjectOutput
+	err = c.retry(ctx, func() error {
+		// Each attempt needs a fresh reader over the data.
+		i.Body = bytes.NewReader(data)
+
+		var req *request.Request
+		req, output = c.nativeClient.PutObjectRequest(i)
+		req.Handlers.Build.PushBack(c.setObjectLock)
+		req.Handlers.Build.PushBack(c.setPrecondition)
+		req.Handlers.Build.PushBack(c.setEncryptionContext)
+		if c.objectLockMode != "" {
+			req.Handlers.Build.PushBack(setContentMD5(data))
+		}
+		if setSum != nil {
+			req.Handlers.Build.PushBack(setSum)
+		}
+		return sendOnce(ctx, req)
+	})
+	if err != nil {
+		return c.uploadError(err)
+	}
+
+	c.etag = aws.StringValue(output.ETag)
+	c.putBackup(ctx)
+	return c.storeDigest(ctx, data)
+}
+
+// setObjectLock is a Build handler that sets the object lock retention of
+// the state object being written. The SDK has no fields for it, so the
+// headers are set directly.
+func (c *S3Client) setObjectLock(r *request.Request) {
+	if c.objectLockMode == "" {
+		return
+	}
+
+	until := time.Now().UTC().AddDate(0, 0, c.objectLockRetainDays)
+	r.HTTPRequest.Header.Set("X-Amz-Object-Lock-Mode", c.objectLockMode)
+	r.HTTPRequest.Header.Set("X-Amz-Object-Lock-Retain-Until-Date", until.Format(time.RFC3339))
+}
+
+// setChecksum returns a Build handler that sends sum, the checksum_algorithm
+// checksum of the object or part being uploaded, in header. The SDK has no
+// fields for the additional checksums, so the headers are set directly
+// before the request is signed.
+func (c *S3Client) setChecksum(header, sum string) func(*request.Request) {
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Amz-Sdk-Checksum-Algorithm", c.checksumAlgorithm)
+		r.HTTPRequest.Header.Set(header, sum)
+	}
+}
+
+// setPrecondition is a Build handler that makes the write of the state
+// object conditional on there being no state yet, when createOnly is set, or
+// on it not having changed since it was last read or written, when
+// optimistic locking is enabled. The SDK has no fields for them.
+func (c *S3Client) setPrecondition(r *request.Request) {
+	switch {
+	case c.createOnly:
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	case c.optimisticLocking && c.etag != "":
+		r.HTTPRequest.Header.Set("If-Match", c.etag)
+	}
+}
+
+// setContentMD5 returns a Build handler that sets the Content-MD5 header,
+// which S3 requires for objects written with a retention period.
+func setContentMD5(data []byte) func(*request.Request) {
+	sum := md5.Sum(data)
+	v := base64.StdEncoding.EncodeToString(sum[:])
+	return func(r *request.Request) {
+		r.HTTPRequest.Header.Set("Content-Md5", v)
+	}
+}
+
+// The vendored SDK predates additional checksums, which S3 requires with
+// the parts when completing an upload created with a checksum algorithm, so
+// the input of CompleteMultipartUpload is defined here.
+
+type completeMultipartUploadInput struct {
+	_ struct{} `type:"structure" payload:"MultipartUpload"`
+
+	Bucket          *string                   `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	Key             *string                   `location:"uri" locationName:"Key" min:"1" type:"string" required:"true"`
+	MultipartUpload *completedMultipartUpload `locationName:"CompleteMultipartUpload" type:"structure"`
+	RequestPayer    *string                   `location:"header" locationName:"x-amz-request-payer" type:"string"`
+	UploadId        *string                   `location:"querystring" locationName:"uploadId" type:"string" required:"true"`
+}
+
+type completedMultipartUpload struct {
+	_ struct{} `type:"structure"`
+
+	Parts []*completedPart `locationName:"Part" type:"list" flattened:"true"`
+}
+
+type completedPart struct {
+	_ struct{} `type:"structure"`
+
+	ChecksumCRC32  *string `type:"string"`
+	ChecksumCRC32C *string `type:"string"`
+	ChecksumSHA1   *string `type:"string"`
+	ChecksumSHA256 *string `type:"string"`
+	ETag           *string `type:"string"`
+	PartNumber     *int64  `type:"integer"`
+}
+
+// setChecksum sets the checksum of the part for the algorithm.
+func (p *completedPart) setChecksum(algorithm, sum string) {
+	switch algorithm {
+	case "CRC32":
+		p.ChecksumCRC32 = &sum
+	case "CRC32C":
+		p.ChecksumCRC32C = &sum
+	case "SHA1":
+		p.ChecksumSHA1 = &sum
+	case "SHA256":
+		p.ChecksumSHA256 = &sum
+	}
+}
+
+// putMultipart uploads data with a multipart upload, applying the same object
+// settings as the single PutObject request i. Parts are read directly from
+// data, so no further copies of the state are made.
+func (c *S3Client) putMultipart(ctx context.Context, i *s3.PutObjectInput, data []byte) error {
+	createInput := &s3.CreateMultipartUploadInput{}
+	awsutil.Copy(createInput, i)
+
+	var upload *s3.CreateMultipartUploadOutput
+	err := c.retry(ctx, func() error {
+		var req *request.Request
+		req, upload = c.nativeClient.CreateMultipartUploadRequest(createInput)
+		req.Handlers.Build.PushBack(c.setObjectLock)
+		req.Handlers.Build.PushBack(c.setEncryptionContext)
+		if c.checksumAlgorithm != "" {
+			req.Handlers.Build.PushBack(func(r *request.Request) {
+				r.HTTPRequest.Header.Set("X-Amz-Checksum-Algorithm", c.checksumAlgorithm)
+			})
+		}
+		return sendOnce(ctx, req)
+	})
+	if err != nil {
+		return err
+	}
+
+	var parts []*completedPart
+	for start := 0; start < len(data); start += multipartPartSize {
+		end := start + multipartPartSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		partInput := &s3.UploadPartInput{}
+		awsutil.Copy(partInput, i)
+		partInput.UploadId = upload.UploadId
+		partInput.PartNumber = aws.Int64(int64(len(parts) + 1))
+		partInput.ContentLength = aws.Int64(int64(end - start))
+
+		completed := &completedPart{PartNumber: partInput.PartNumber}
+		var setSum func(*request.Request)
+		if c.checksumAlgorithm != "" {
+			// S3 checks each part against its checksum, and the upload
+			// against the checksums of all the parts when it's completed.
+			header, sum, err := checksum(c.checksumAlgorithm, data[start:end])
+			if err != nil {
+				c.abortMultipart(upload.UploadId)
+				return err
+			}
+			setSum = c.setChecksum(header, sum)
+			completed.setChecksum(c.checksumAlgorithm, sum)
+		}
+
+		var part *s3.UploadPartOutput
+		err := c.retry(ctx, func() error {
+			partInput.Body = bytes.NewReader(data[start:end])
+			var req *request.Request
+			req, part = c.nativeClient.UploadPartRequest(partInput)
+			if c.objectLockMode != "" {
+				req.Handlers.Build.PushBack(setContentMD5(data[start:end]))
+			}
+			if setSum != nil {
+				req.Handlers.Build.PushBack(setSum)
+			}
+			return sendOnce(ctx, req)
+		})
+		if err != nil {
+			c.abortMultipart(upload.UploadId)
+			return err
+		}
+
+		completed.ETag = part.ETag
+		parts = append(parts, completed)
+	}
+
+	var output *s3.CompleteMultipartUploadOutput
+	err = c.retry(ctx, func() error {
+		var req *request.Request
+		req, output = c.nativeClient.CompleteMultipartUploadRequest(nil)
+		// The request is made by the SDK, so S3 errors returned with a 200
+		// status are still detected, but sent with the input defined here,
+		// which has the checksums of the parts.
+		req.Params = &completeMultipartUploadInput{
+			Bucket:          i.Bucket,
+			Key:             i.Key,
+			UploadId:        upload.UploadId,
+			MultipartUpload: &completedMultipartUpload{Parts: parts},
+			RequestPayer:    i.RequestPayer,
+		}
+		req.Handlers.Build.PushBack(c.setPrecondition)
+		return sendOnce(ctx, req)
+	})
+	if err != nil {
+		c.abortMultipart(upload.UploadId)
+		return err
+	}
+
+	c.etag = aws.StringValue(output.ETag)
+	return nil
+}
+
+// abortMultipart cleans up a failed multipart upload so its parts don't
+// linger in the bucket. It runs even when the upload was cancelled.
+func (c *S3Client) abortMultipart(uploadID *string) {
+	_, err := c.nativeClient.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:       &c.bucketName,
+		Key:          &c.keyName,
+		UploadId:     uploadID,
+		RequestPayer: c.requestPayerValue(),
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to abort multipart upload %s of S3 state: %s", *uploadID, err)
+	}
+}
+
+// checksumAlgorithms are the supported values for checksum_algorithm.
+var checksumAlgorithms = []string{"CRC32", "CRC32C", "SHA1", "SHA256"}
+
+// checksum returns the request header carrying the checksum of data for
+// the given algorithm, along with its base64 encoded value.
+func checksum(algorithm string, data []byte) (string, string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "CRC32":
+		h = crc32.NewIEEE()
+	case "CRC32C":
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "SHA1":
+		h = sha1.New()
+	case "SHA256":
+		h = sha256.New()
+	default:
+		return "", "", fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	h.Write(data)
+
+	header := "X-Amz-Checksum-" + strings.ToLower(algorithm)
+	return header, base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *S3Client) Delete() error {
+	return c.DeleteWithContext(context.Background())
+}
+
+// DeleteWithContext is Delete, stopping when ctx is done.
+func (c *S3Client) DeleteWithContext(ctx context.Context) (err error) {
+	if c.hooks != nil && c.hooks.OnDelete != nil {
+		defer observe(c.hooks.OnDelete, time.Now(), &err)
+	}
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "delete", &err)
+
+	if c.dryRun {
+		log.Printf("[INFO] Dry run: would delete state %s", c.StatePath())
+		return nil
+	}
+
+	switch {
+	case c.softDelete:
+		err = c.moveToTrash(ctx)
+	case c.purgeVersions:
+		err = c.deleteAllVersions(ctx)
+	default:
+		req, _ := c.nativeClient.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket:       &c.bucketName,
+			Key:          &c.keyName,
+			RequestPayer: c.requestPayerValue(),
+		})
+		err = classifyAction(sendWithContext(ctx, req), "s3:DeleteObject", c.StatePath())
+	}
+	if err != nil {
+		return err
+	}
+
+	// A checksum left behind would fail the read of new state at the path.
+	if c.lockTable != "" {
+		if err := c.putDigest(ctx, ""); err != nil {
+			return fmt.Errorf("Error removing state checksum from DynamoDB: %s", err)
+		}
+	}
+	return nil
+}
+
+// listAllKeys returns the keys of every object in the bucket whose key
+// starts with prefix, following the continuation token until the listing
+// isn't truncated.
+func (c *S3Client) listAllKeys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.listObjects(ctx, prefix, "", func(out *s3.ListObjectsV2Output) {
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// listWorkspaces returns the names of the workspaces whose states are
+// stored under prefix as prefix/name/key. Listing with a delimiter leaves
+// out other objects under prefix, and doesn't list every object of every
+// workspace; a "directory" is only a workspace if it holds the state.
+func (c *S3Client) listWorkspaces(ctx context.Context, prefix string) ([]string, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	var names []string
+	err := c.listObjects(ctx, prefix, "/", func(out *s3.ListObjectsV2Output) {
+		for _, p := range out.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/")
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var workspaces []string
+	for _, name := range names {
+		wc := *c
+		wc.keyName = prefix + name + "/" + c.keyName
+		exists, err := wc.ExistsWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			workspaces = append(workspaces, name)
+		}
+	}
+	return workspaces, nil
+}
+
+// listObjects calls fn with each page of the objects whose key starts with
+// prefix, grouping keys by delimiter if it isn't empty. It stops when ctx is
+// done.
+func (c *S3Client) listObjects(ctx context.Context, prefix, delimiter string, fn func(*s3.ListObjectsV2Output)) error {
+	var token *string
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket:            &c.bucketName,
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+			RequestPayer:      c.requestPayerValue(),
+		}
+		if delimiter != "" {
+			input.Delimiter = aws.String(delimiter)
+		}
+
+		var out *s3.ListObjectsV2Output
+		err := c.retry(ctx, func() error {
+			var req *request.Request
+			req, out = c.nativeClient.ListObjectsV2Request(input)
+			return sendOnce(ctx, req)
+		})
+		if err != nil {
+			return fmt.Errorf("Error listing objects with prefix %q in bucket %q: %s", prefix, c.bucketName, classify(err))
+		}
+
+		fn(out)
+
+		if !aws.BoolValue(out.IsTruncated) {
+			return nil
+		}
+		if aws.StringValue(out.NextContinuationToken) == "" {
+			return fmt.Errorf("Error listing objects with prefix %q in bucket %q: truncated listing has no continuation token", prefix, c.bucketName)
+		}
+		token = out.NextContinuationToken
+	}
+}
+
+// deleteObjectsLimit is the most objects a DeleteObjects request can delete.
+const deleteObjectsLimit = 1000
+
+// deleteAllVersions deletes every version and delete marker of the state.
+func (c *S3Client) deleteAllVersions(ctx context.Context) error {
+	var objects []*s3.ObjectIdentifier
+	err := c.listObjectVersions(ctx, func(page *s3.ListObjectVersionsOutput) {
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) == c.keyName {
+				objects = append(objects, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if aws.StringValue(m.Key) == c.keyName {
+				objects = append(objects, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for start := 0; start < len(objects); start += deleteObjectsLimit {
+		end := start + deleteObjectsLimit
+		if end > len(objects) {
+			end = len(objects)
+		}
+
+		req, out := c.nativeClient.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+			Bucket:       &c.bucketName,
+			Delete:       &s3.Delete{Objects: objects[start:end], Quiet: aws.Bool(true)},
+			RequestPayer: c.requestPayerValue(),
+		})
+		if err := sendWithContext(ctx, req); err != nil {
+			return fmt.Errorf("Error deleting versions of state %s: %s", c.StatePath(), err)
+		}
+
+		// Objects that couldn't be deleted are reported in the response.
+		if len(out.Errors) > 0 {
+			var errs []error
+			for _, e := range out.Errors {
+				errs = append(errs, fmt.Errorf("version %s: %s: %s",
+					aws.StringValue(e.VersionId), aws.StringValue(e.Code), aws.StringValue(e.Message)))
+			}
+			return fmt.Errorf("Error deleting versions of state %s: %s", c.StatePath(), &multierror.Error{Errors: errs})
+		}
+	}
+
+	log.Printf("[DEBUG] Deleted %d versions of state %s", len(objects), c.StatePath())
+	return nil
+}
+
+// Move moves the state to key in the same bucket, along with its lock if
+// it's locked and its stored checksum, and points the client at the new key. It fails if state
+// already exists at key, unless force is set. The state at the old key is
+// removed like Delete removes it, along with its stored checksum.
+func (c *S3Client) Move(key string, force bool) error {
+	return c.MoveWithContext(context.Background(), key, force)
+}
+
+// MoveWithContext is Move, stopping when ctx is done.
+func (c *S3Client) MoveWithContext(ctx context.Context, key string, force bool) error {
+	key = normalizeKey(key)
+	if key == c.keyName {
+		return nil
+	}
+
+	if c.dryRun {
+		log.Printf("[INFO] Dry run: would move state %s to %q", c.StatePath(), key)
+		return nil
+	}
+
+	if !force {
+		dst := *c
+		dst.keyName = key
+		exists, err := dst.ExistsWithContext(ctx)
+		if err != nil {
+			return wrapf(err, "Error checking for state at %q: %s", key, err)
+		}
+		if exists {
+			return fmt.Errorf("Cannot move state to %q, state already exists there", key)
+		}
+	}
+
+	if err := c.copyState(ctx, key); err != nil {
+		return err
+	}
+
+	if err := c.moveLock(key, force); err != nil {
+		return err
+	}
+
+	if err := c.DeleteWithContext(ctx); err != nil {
+		return fmt.Errorf("State was copied to %q, but deleting it from %q failed: %s", key, c.keyName, err)
+	}
+
+	c.keyName = key
+	c.etag = ""
+	return nil
+}
+
+// backupKey returns the key of the copy of the state written with
+// write_backup.
+func (c *S3Client) backupKey() string {
+	return c.keyName + ".backup"
+}
+
+// putBackup copies the state that was just written to backupKey, if
+// write_backup is set. The state was written, so a failed copy is only
+// logged.
+func (c *S3Client) putBackup(ctx context.Context) {
+	if !c.writeBackup {
+		return
+	}
+	if err := c.copyState(ctx, c.backupKey()); err != nil {
+		log.Printf("[WARN] Failed to write a backup of state %s: %s", c.StatePath(), err)
+		return
+	}
+	log.Printf("[DEBUG] Wrote a backup of state %s to %q", c.StatePath(), c.backupKey())
+}
+
+// copyState copies the state object, and its stored checksum, to key. The
+// copy keeps the metadata and content encoding of the state, but encryption
+// and the ACL are set like they are by Put.
+func (c *S3Client) copyState(ctx context.Context, key string) error {
+	copyInput := &s3.CopyObjectInput{
+		Bucket:       &c.bucketName,
+		Key:          &key,
+		CopySource:   aws.String(c.bucketName + "/" + escapeKey(c.keyName)),
+		RequestPayer: c.requestPayerValue(),
+	}
+	if c.serverSideEncryption && !c.bucketEncryption {
+		if c.kmsKeyID != "" {
+			copyInput.SSEKMSKeyId = &c.kmsKeyID
+			copyInput.ServerSideEncryption = aws.String("aws:kms")
+		} else {
+			copyInput.ServerSideEncryption = aws.String("AES256")
+		}
+	}
+	if c.acl != "" {
+		copyInput.ACL = aws.String(c.acl)
+	}
+
+	req, _ := c.nativeClient.CopyObjectRequest(copyInput)
+	req.Handlers.Build.PushBack(c.setEncryptionContext)
+	if err := sendWithContext(ctx, req); err != nil {
+		return classify(wrapf(err, "Error copying state to %q: %s", key, err))
+	}
+	return c.copyDigest(ctx, key)
 }
 
-func (c *S3Client) Get() (*remote.Payload, error) {
-	output, err := c.nativeClient.GetObject(&s3.GetObjectInput{
-		Bucket: &c.bucketName,
-		Key:    &c.keyName,
-	})
+// moveLock moves the lock of the state, if any, to the lock path of key.
+func (c *S3Client) moveLock(key string, force bool) error {
+	// A configured lock ID doesn't change with the key.
+	if c.lockTable == "" || c.lockID != "" {
+		return nil
+	}
 
+	oldPath := c.LockPath()
+	out, err := c.dynClient.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			c.lockKeyName: {S: aws.String(oldPath)},
+		},
+		TableName:      aws.String(c.lockTable),
+		ConsistentRead: aws.Bool(true),
+	})
 	if err != nil {
-		if awserr := err.(awserr.Error); awserr != nil {
-			if awserr.Code() == "NoSuchKey" {
-				return nil, nil
-			} else {
-				return nil, err
-			}
-		} else {
-			return nil, err
+		return fmt.Errorf("Error reading lock %q: %s", oldPath, err)
+	}
+	if len(out.Item) == 0 {
+		return nil
+	}
+
+	newPath := fmt.Sprintf("%s/%s", c.bucketName, key)
+	item := out.Item
+	item[c.lockKeyName] = &dynamodb.AttributeValue{S: aws.String(newPath)}
+	if _, ok := item["Path"]; ok {
+		item["Path"] = &dynamodb.AttributeValue{S: aws.String(newPath)}
+	}
+
+	putInput := &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(c.lockTable),
+	}
+	if !force {
+		putInput.ConditionExpression = aws.String("attribute_not_exists(#key)")
+		putInput.ExpressionAttributeNames = map[string]*string{
+			"#key": aws.String(c.lockKeyName),
+		}
+	}
+	if _, err := c.dynClient.PutItem(putInput); err != nil {
+		if isConditionalCheckFailed(err) {
+			return fmt.Errorf("Cannot move lock %q to %q, which is locked", oldPath, newPath)
 		}
+		return fmt.Errorf("Error moving lock %q to %q: %s", oldPath, newPath, err)
 	}
 
-	defer output.Body.Close()
+	_, err = c.dynClient.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			c.lockKeyName: {S: aws.String(oldPath)},
+		},
+		TableName: aws.String(c.lockTable),
+	})
+	if err != nil {
+		return fmt.Errorf("Error deleting lock %q after moving it: %s", oldPath, err)
+	}
+	return nil
+}
 
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, output.Body); err != nil {
-		return nil, fmt.Errorf("Failed to read remote state: %s", err)
+// escapeKey escapes each segment of an object key for a copy source.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
 	}
+	return strings.Join(segments, "/")
+}
 
-	payload := &remote.Payload{
-		Data: buf.Bytes(),
+// validateBucket checks that the bucket exists in the configured region, so
+// that a misconfiguration is reported clearly up front rather than as a
+// confusing error from the first state operation.
+func (c *S3Client) validateBucket() error {
+	req, _ := c.nativeClient.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: &c.bucketName,
+	})
+	err := req.Send()
+	if err == nil {
+		return nil
 	}
 
-	// If there was no data, then return nil
-	if len(payload.Data) == 0 {
-		return nil, nil
+	// S3 reports the real region of the bucket when it is asked in the
+	// wrong one.
+	region := aws.StringValue(c.nativeClient.Config.Region)
+	if req.HTTPResponse != nil {
+		actual := req.HTTPResponse.Header.Get("X-Amz-Bucket-Region")
+		if actual != "" && actual != region {
+			return &Error{
+				Kind: ErrBucketRegionMismatch,
+				Err:  fmt.Errorf(strings.TrimSpace(errBucketRegion), c.bucketName, actual, region, actual),
+			}
+		}
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch {
+		case reqErr.StatusCode() == 404:
+			return fmt.Errorf("S3 bucket %q does not exist.", c.bucketName)
+		case reqErr.StatusCode() == 301 || reqErr.Code() == "AuthorizationHeaderMalformed":
+			return &Error{
+				Kind: ErrBucketRegionMismatch,
+				Err:  fmt.Errorf("S3 bucket %q is not in the configured region %q.", c.bucketName, region),
+			}
+		}
 	}
 
-	return payload, nil
+	return fmt.Errorf("Error validating S3 bucket %q: %s", c.bucketName, err)
 }
 
-func (c *S3Client) Put(data []byte) error {
-	contentType := "application/json"
-	contentLength := int64(len(data))
+// check verifies that the bucket and lock table can be accessed, returning
+// an error for each that can't.
+func (c *S3Client) check() error {
+	var errs []error
 
-	i := &s3.PutObjectInput{
-		ContentType:   &contentType,
-		ContentLength: &contentLength,
-		Body:          bytes.NewReader(data),
-		Bucket:        &c.bucketName,
-		Key:           &c.keyName,
+	_, err := c.nativeClient.HeadBucket(&s3.HeadBucketInput{
+		Bucket: &c.bucketName,
+	})
+	if err != nil {
+		errs = append(errs, checkError(
+			fmt.Sprintf("S3 bucket %q", c.bucketName), "s3:ListBucket", err))
 	}
 
-	if c.serverSideEncryption {
-		if c.kmsKeyID != "" {
-			i.SSEKMSKeyId = &c.kmsKeyID
-			i.ServerSideEncryption = aws.String("aws:kms")
-		} else {
-			i.ServerSideEncryption = aws.String("AES256")
+	if c.lockTable != "" {
+		_, err := c.dynClient.DescribeTable(&dynamodb.DescribeTableInput{
+			TableName: aws.String(c.lockTable),
+		})
+		if err != nil {
+			errs = append(errs, checkError(
+				fmt.Sprintf("DynamoDB table %q", c.lockTable), "dynamodb:DescribeTable", err))
 		}
 	}
 
-	if c.acl != "" {
-		i.ACL = aws.String(c.acl)
+	if len(errs) > 0 {
+		return &multierror.Error{Errors: errs}
 	}
+	return nil
+}
 
-	log.Printf("[DEBUG] Uploading remote state to S3: %#v", i)
+// checkError describes an error accessing resource, naming the permission
+// that's missing if access was denied.
+func checkError(resource, permission string, err error) error {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		if reqErr.StatusCode() == 403 || strings.Contains(reqErr.Code(), "AccessDenied") {
+			return fmt.Errorf("Access denied to %s, the %s permission may be missing: %s",
+				resource, permission, err)
+		}
+	}
+	return fmt.Errorf("Error accessing %s: %s", resource, err)
+}
+
+// ensureBucketLogging enables server access logging of the bucket to the
+// target bucket and prefix, unless it's already enabled with them.
+func (c *S3Client) ensureBucketLogging(targetBucket, targetPrefix string) error {
+	current, err := c.nativeClient.GetBucketLogging(&s3.GetBucketLoggingInput{
+		Bucket: &c.bucketName,
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading access logging of S3 bucket %q: %s", c.bucketName, err)
+	}
+	if l := current.LoggingEnabled; l != nil &&
+		aws.StringValue(l.TargetBucket) == targetBucket && aws.StringValue(l.TargetPrefix) == targetPrefix {
+		return nil
+	}
+
+	log.Printf("[INFO] Enabling access logging of S3 bucket %q to %s/%s", c.bucketName, targetBucket, targetPrefix)
+	_, err = c.nativeClient.PutBucketLogging(&s3.PutBucketLoggingInput{
+		Bucket: &c.bucketName,
+		BucketLoggingStatus: &s3.BucketLoggingStatus{
+			LoggingEnabled: &s3.LoggingEnabled{
+				TargetBucket: aws.String(targetBucket),
+				TargetPrefix: aws.String(targetPrefix),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error enabling access logging of S3 bucket %q: %s", c.bucketName, err)
+	}
+	return nil
+}
+
+// checkLockTable checks that the lock table exists and can be used, so that a
+// misspelt table name or a wrong region fails when the backend is configured
+// rather than when the state is first locked. Taking the lock doesn't need
+// the dynamodb:DescribeTable permission, so if it's missing the table can't
+// be checked, which is only logged.
+func (c *S3Client) checkLockTable() error {
+	out, err := c.dynClient.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(c.lockTable),
+	})
+	if err != nil {
+		err = classify(err)
+		switch {
+		case isError(err, ErrLockTableMissing):
+			return fmt.Errorf(strings.TrimSpace(errLockTableNotFound), c.lockTable, aws.StringValue(c.dynClient.Config.Region))
+		case isError(err, ErrAccessDenied):
+			log.Printf("[WARN] Can't check DynamoDB table %q, the dynamodb:DescribeTable permission may be missing: %s", c.lockTable, err)
+			return nil
+		}
+		return fmt.Errorf("Error checking DynamoDB table %q for state locking: %s", c.lockTable, err)
+	}
 
-	if _, err := c.nativeClient.PutObject(i); err == nil {
+	// Tables being updated can still be read and written.
+	switch status := aws.StringValue(out.Table.TableStatus); status {
+	case dynamodb.TableStatusActive, dynamodb.TableStatusUpdating:
 		return nil
-	} else {
-		return fmt.Errorf("Failed to upload state: %v", err)
+	default:
+		return fmt.Errorf("DynamoDB table %q for state locking is %s, not ACTIVE", c.lockTable, status)
 	}
 }
 
-func (c *S3Client) Delete() error {
-	_, err := c.nativeClient.DeleteObject(&s3.DeleteObjectInput{
+// checkVersioning returns an error unless versioning is enabled on the
+// bucket, for teams that rely on it to recover state instead of locking.
+func (c *S3Client) checkVersioning() error {
+	out, err := c.nativeClient.GetBucketVersioning(&s3.GetBucketVersioningInput{
 		Bucket: &c.bucketName,
-		Key:    &c.keyName,
 	})
+	if err != nil {
+		return fmt.Errorf("Error reading versioning of S3 bucket %q: %s", c.bucketName, classify(err))
+	}
 
-	return err
+	status := aws.StringValue(out.Status)
+	if status == s3.BucketVersioningStatusEnabled {
+		return nil
+	}
+	if status == "" {
+		status = "never been enabled"
+	} else {
+		status = "is " + status
+	}
+	return fmt.Errorf("require_versioning is set, but versioning of S3 bucket %q %s. "+
+		"Enable versioning on the bucket, so earlier versions of the state can be recovered.", c.bucketName, status)
 }
 
 func (c *S3Client) Lock(info *state.LockInfo) (string, error) {
+	return c.LockWithContext(context.Background(), info)
+}
+
+// LockWithContext is Lock, stopping when ctx is done, including while
+// waiting for a held lock.
+func (c *S3Client) LockWithContext(ctx context.Context, info *state.LockInfo) (id string, err error) {
+	if c.hooks != nil && c.hooks.OnLock != nil {
+		defer observe(c.hooks.OnLock, time.Now(), &err)
+	}
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "lock", &err)
+
 	if c.lockTable == "" {
 		return "", nil
 	}
 
-	stateName := fmt.Sprintf("%s/%s", c.bucketName, c.keyName)
+	stateName := c.LockPath()
 	info.Path = stateName
 
 	if info.ID == "" {
@@ -125,72 +1419,444 @@ func (c *S3Client) Lock(info *state.LockInfo) (string, error) {
 		info.ID = lockID
 	}
 
+	if c.dryRun {
+		log.Printf("[INFO] Dry run: would take lock %q in DynamoDB table %q with ID %q",
+			stateName, c.lockTable, info.ID)
+		return info.ID, nil
+	}
+
+	// The lock ID and path are stored as their own attributes so that
+	// Unlock can check the ID in the same request that deletes the lock.
+	item := map[string]*dynamodb.AttributeValue{
+		c.lockKeyName: {S: aws.String(stateName)},
+		"ID":          {S: aws.String(info.ID)},
+		"Path":        {S: aws.String(info.Path)},
+		"Info":        {S: aws.String(string(info.Marshal()))},
+		"Created":     {S: aws.String(info.Created.UTC().Format(time.RFC3339))},
+	}
+
+	// The most useful fields of Info are also stored as their own
+	// attributes, so locks can be inspected in the DynamoDB console.
+	// DynamoDB doesn't allow empty strings.
+	if info.Who != "" {
+		item["Who"] = &dynamodb.AttributeValue{S: aws.String(info.Who)}
+	}
+	if info.Operation != "" {
+		item["Operation"] = &dynamodb.AttributeValue{S: aws.String(info.Operation)}
+	}
+
 	putParams := &dynamodb.PutItemInput{
-		Item: map[string]*dynamodb.AttributeValue{
-			"LockID": {S: aws.String(stateName)},
-			"Info":   {S: aws.String(string(info.Marshal()))},
-		},
+		Item:                item,
 		TableName:           aws.String(c.lockTable),
-		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+		ConditionExpression: aws.String("attribute_not_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String(c.lockKeyName),
+		},
+		ReturnConsumedCapacity: c.returnConsumedCapacity(),
+	}
+	if c.lockTTL > 0 {
+		// Locks without an expiry, taken without lock_ttl, never expire.
+		putParams.ConditionExpression = aws.String("attribute_not_exists(#key) OR Expires < :now")
+		putParams.ReturnValues = aws.String(dynamodb.ReturnValueAllOld)
+	}
+	// Server errors and throttling are retried, but a failed condition
+	// means the lock is held and is handled below.
+	putItem := func() error {
+		if c.lockTTL > 0 {
+			now := time.Now()
+			item["Expires"] = &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(now.Add(c.lockTTL).Unix(), 10)),
+			}
+			putParams.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			}
+		}
+		return c.retry(ctx, func() error {
+			req, out := c.dynClient.PutItemRequest(putParams)
+			if err := sendOnce(ctx, req); err != nil {
+				return err
+			}
+			logConsumedCapacity("PutItem", out.ConsumedCapacity)
+			if old := out.Attributes["ID"]; old != nil {
+				log.Printf("[WARN] Took over expired S3 state lock %q with ID %q", stateName, aws.StringValue(old.S))
+			}
+			return nil
+		})
 	}
-	_, err := c.dynClient.PutItem(putParams)
+	err = putItem()
 
-	if err != nil {
-		lockInfo, infoErr := c.getLockInfo()
-		if infoErr != nil {
-			err = multierror.Append(err, infoErr)
+	// Keep retrying while someone else holds the lock, until lockTimeout
+	// has elapsed, lockMaxAttempts have been made or ctx is done.
+	deadline := time.Now().Add(c.lockTimeout)
+	delay := lockRetryMinDelay
+	if c.lockPollInterval > 0 {
+		delay = c.lockPollInterval
+	}
+	for attempts := 1; err != nil && isConditionalCheckFailed(err); attempts++ {
+		if c.lockMaxAttempts > 0 && attempts >= c.lockMaxAttempts {
+			break
+		}
+		if c.lockTimeout > 0 {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				break
+			}
+			if delay > remaining {
+				delay = remaining
+			}
+		} else if c.lockMaxAttempts == 0 {
+			break
+		}
+
+		log.Printf("[DEBUG] S3 state lock %q is held, retrying in %s", stateName, delay)
+		if !sleepWithContext(ctx, delay) {
+			break
 		}
 
+		if c.lockPollInterval == 0 {
+			delay *= 2
+			if delay > lockRetryMaxDelay {
+				delay = lockRetryMaxDelay
+			}
+		}
+
+		err = putItem()
+	}
+
+	if err != nil {
 		lockErr := &state.LockError{
-			Err:  err,
-			Info: lockInfo,
+			Err: classifyAction(err, "dynamodb:PutItem", c.lockTableResource()),
+		}
+
+		// Report who holds the lock. It's read even when ctx is done,
+		// since that's what ended the wait for the lock.
+		if isConditionalCheckFailed(err) {
+			infoCtx, cancel := context.WithTimeout(context.Background(), lockInfoTimeout)
+			lockInfo, infoErr := c.getLockInfo(infoCtx)
+			cancel()
+			if infoErr != nil {
+				lockErr.Err = multierror.Append(err, infoErr)
+			}
+			lockErr.Info = lockInfo
 		}
 		return "", lockErr
 	}
 	return info.ID, nil
 }
 
-func (c *S3Client) getLockInfo() (*state.LockInfo, error) {
+// isConditionalCheckFailed returns true if err was caused by the lock
+// condition on PutItem, meaning the lock is already held.
+func isConditionalCheckFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// StatePath returns the bucket and key of the state object, as "bucket/key".
+func (c *S3Client) StatePath() string {
+	return fmt.Sprintf("%s/%s", c.bucketName, c.keyName)
+}
+
+// returnConsumedCapacity returns the ReturnConsumedCapacity of lock table
+// requests, which is only set with debug_consumed_capacity.
+func (c *S3Client) returnConsumedCapacity() *string {
+	if !c.debugCapacity {
+		return nil
+	}
+	return aws.String(dynamodb.ReturnConsumedCapacityTotal)
+}
+
+// logConsumedCapacity logs the capacity consumed by a lock table request, if
+// it was returned.
+func logConsumedCapacity(op string, cc *dynamodb.ConsumedCapacity) {
+	if cc == nil {
+		return
+	}
+	log.Printf("[DEBUG] DynamoDB %s on table %q consumed %g capacity units",
+		op, aws.StringValue(cc.TableName), aws.Float64Value(cc.CapacityUnits))
+}
+
+// lockTableResource describes the lock table in errors.
+func (c *S3Client) lockTableResource() string {
+	return fmt.Sprintf("DynamoDB table %q", c.lockTable)
+}
+
+// LockPath returns the key of the state's lock in the lock table, which is
+// the state path unless a lock ID was configured.
+func (c *S3Client) LockPath() string {
+	if c.lockID != "" {
+		return c.lockID
+	}
+	return c.StatePath()
+}
+
+// batchWriteLimit is the most items a DynamoDB BatchWriteItem request can
+// contain.
+const batchWriteLimit = 25
+
+// DeleteLocks deletes every lock in the lock table for state in the bucket
+// whose key starts with prefix, such as the locks of a set of workspaces
+// being torn down, and returns how many were deleted. Locks are deleted
+// regardless of who holds them. It stops when ctx is done.
+func (c *S3Client) DeleteLocks(ctx context.Context, prefix string) (int, error) {
+	if c.lockTable == "" {
+		return 0, nil
+	}
+
+	var keys []map[string]*dynamodb.AttributeValue
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(c.lockTable),
+		ProjectionExpression: aws.String("#key"),
+		// Only locks have Info; stored state checksums are left alone.
+		FilterExpression: aws.String("begins_with(#key, :prefix) AND attribute_exists(Info)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key": aws.String(c.lockKeyName),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(c.bucketName + "/" + prefix)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	for {
+		var page *dynamodb.ScanOutput
+		err := c.retry(ctx, func() error {
+			var req *request.Request
+			req, page = c.dynClient.ScanRequest(input)
+			return sendOnce(ctx, req)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Error listing locks in DynamoDB table %q: %s", c.lockTable, classify(err))
+		}
+
+		keys = append(keys, page.Items...)
+		if len(page.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = page.LastEvaluatedKey
+	}
+
+	deleted := 0
+	for start := 0; start < len(keys); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var requests []*dynamodb.WriteRequest
+		for _, key := range keys[start:end] {
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: key},
+			})
+		}
+
+		n, err := c.batchDelete(ctx, requests)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// batchDelete sends the delete requests in a single BatchWriteItem, retrying
+// any items DynamoDB leaves unprocessed with backoff. It returns how many
+// items were deleted.
+func (c *S3Client) batchDelete(ctx context.Context, requests []*dynamodb.WriteRequest) (int, error) {
+	total := len(requests)
+	for attempt := 0; ; attempt++ {
+		var out *dynamodb.BatchWriteItemOutput
+		err := c.retry(ctx, func() error {
+			var req *request.Request
+			req, out = c.dynClient.BatchWriteItemRequest(&dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{
+					c.lockTable: requests,
+				},
+			})
+			return sendOnce(ctx, req)
+		})
+		if err != nil {
+			return total - len(requests), fmt.Errorf("Error deleting locks from DynamoDB table %q: %s", c.lockTable, classify(err))
+		}
+
+		requests = out.UnprocessedItems[c.lockTable]
+		if len(requests) == 0 {
+			return total, nil
+		}
+		if attempt >= c.maxRetries {
+			return total - len(requests), fmt.Errorf("Error deleting locks from DynamoDB table %q: %d locks were left unprocessed",
+				c.lockTable, len(requests))
+		}
+
+		delay := retryDelay(attempt)
+		log.Printf("[DEBUG] %d locks were left unprocessed, retrying in %s", len(requests), delay)
+		if !sleepWithContext(ctx, delay) {
+			return total - len(requests), fmt.Errorf("Error deleting locks from DynamoDB table %q: %s", c.lockTable, ctx.Err())
+		}
+	}
+}
+
+// waitForTableActive polls the lock table until it is ACTIVE, with
+// exponential backoff between polls. It gives up after timeout, or when ctx
+// is cancelled.
+func (c *S3Client) waitForTableActive(ctx context.Context, tableName string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input := &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, resp := c.dynClient.DescribeTableRequest(input)
+		if err := sendWithContext(ctx, req); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("Error waiting for DynamoDB table %q to become active: %s", tableName, ctx.Err())
+			}
+			return err
+		}
+
+		status := aws.StringValue(resp.Table.TableStatus)
+		if status == dynamodb.TableStatusActive {
+			return nil
+		}
+
+		delay := retryDelay(attempt)
+		log.Printf("[DEBUG] DynamoDB table %q is %s, checking again in %s", tableName, status, delay)
+
+		if !sleepWithContext(ctx, delay) {
+			return fmt.Errorf("Error waiting for DynamoDB table %q to become active (status %s): %s",
+				tableName, status, ctx.Err())
+		}
+	}
+}
+
+// errNoLock is returned by getLockInfo when there's no lock on the state.
+var errNoLock = errors.New("no lock found")
+
+func (c *S3Client) getLockInfo(ctx context.Context) (*state.LockInfo, error) {
 	getParams := &dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
-			"LockID": {S: aws.String(fmt.Sprintf("%s/%s", c.bucketName, c.keyName))},
+			c.lockKeyName: {S: aws.String(c.LockPath())},
 		},
-		ProjectionExpression: aws.String("LockID, Info"),
-		TableName:            aws.String(c.lockTable),
+		ProjectionExpression: aws.String("#key, Info, ID, #path"),
+		// Path is a DynamoDB reserved word, and the key may be one.
+		ExpressionAttributeNames: map[string]*string{
+			"#key":  aws.String(c.lockKeyName),
+			"#path": aws.String("Path"),
+		},
+		TableName:              aws.String(c.lockTable),
+		ConsistentRead:         aws.Bool(c.consistentRead),
+		ReturnConsumedCapacity: c.returnConsumedCapacity(),
 	}
 
-	resp, err := c.dynClient.GetItem(getParams)
+	var resp *dynamodb.GetItemOutput
+	err := c.retry(ctx, func() error {
+		var req *request.Request
+		req, resp = c.dynClient.GetItemRequest(getParams)
+		return sendOnce(ctx, req)
+	})
 	if err != nil {
 		return nil, err
 	}
+	logConsumedCapacity("GetItem", resp.ConsumedCapacity)
+
+	if len(resp.Item) == 0 {
+		return nil, errNoLock
+	}
+	return lockInfoFromItem(resp.Item)
+}
 
+// lockInfoFromItem parses the lock info stored in a lock table item.
+func lockInfoFromItem(item map[string]*dynamodb.AttributeValue) (*state.LockInfo, error) {
 	var infoData string
-	if v, ok := resp.Item["Info"]; ok && v.S != nil {
+	if v, ok := item["Info"]; ok && v.S != nil {
 		infoData = *v.S
 	}
 
 	lockInfo := &state.LockInfo{}
-	err = json.Unmarshal([]byte(infoData), lockInfo)
+	err := json.Unmarshal([]byte(infoData), lockInfo)
 	if err != nil {
 		return nil, err
 	}
 
+	// Locks taken by older versions only have the Info attribute.
+	if v, ok := item["ID"]; ok && v.S != nil {
+		lockInfo.ID = *v.S
+	}
+	if v, ok := item["Path"]; ok && v.S != nil {
+		lockInfo.Path = *v.S
+	}
+
 	return lockInfo, nil
 }
 
+// LockRecord returns every attribute of the lock table item for the state,
+// for tools that need to inspect a lock before forcing it to be released.
+// It returns nil if the state isn't locked or locking isn't enabled.
+func (c *S3Client) LockRecord(ctx context.Context) (map[string]*dynamodb.AttributeValue, error) {
+	if c.lockTable == "" {
+		return nil, nil
+	}
+
+	getParams := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			c.lockKeyName: {S: aws.String(c.LockPath())},
+		},
+		TableName:      aws.String(c.lockTable),
+		ConsistentRead: aws.Bool(c.consistentRead),
+	}
+
+	var resp *dynamodb.GetItemOutput
+	err := c.retry(ctx, func() error {
+		var req *request.Request
+		req, resp = c.dynClient.GetItemRequest(getParams)
+		return sendOnce(ctx, req)
+	})
+	if err != nil {
+		return nil, classifyAction(err, "dynamodb:GetItem", c.lockTableResource())
+	}
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+	return resp.Item, nil
+}
+
 func (c *S3Client) Unlock(id string) error {
+	return c.UnlockWithContext(context.Background(), id)
+}
+
+// UnlockWithContext is Unlock, stopping when ctx is done.
+func (c *S3Client) UnlockWithContext(ctx context.Context, id string) (err error) {
+	if c.hooks != nil && c.hooks.OnUnlock != nil {
+		defer observe(c.hooks.OnUnlock, time.Now(), &err)
+	}
+	ctx, cancel := c.withOperationTimeout(ctx)
+	defer cancel()
+	defer c.checkOperationTimeout(ctx, "unlock", &err)
+
 	if c.lockTable == "" {
 		return nil
 	}
 
+	if c.dryRun {
+		log.Printf("[INFO] Dry run: would release lock %q in DynamoDB table %q with ID %q",
+			c.LockPath(), c.lockTable, id)
+		return nil
+	}
+
 	lockErr := &state.LockError{}
 
-	// TODO: store the path and lock ID in separate fields, and have proper
-	// projection expression only delete the lock if both match, rather than
-	// checking the ID from the info field first.
-	lockInfo, err := c.getLockInfo()
+	lockInfo, err := c.getLockInfo(ctx)
+	if isError(err, errNoLock) {
+		// Someone else released the lock already, such as with a concurrent
+		// force-unlock. Either way the state isn't locked anymore.
+		log.Printf("[WARN] Lock %q with ID %q was already released", c.LockPath(), id)
+		return nil
+	}
 	if err != nil {
-		lockErr.Err = fmt.Errorf("failed to retrieve lock info: %s", err)
+		lockErr.Err = classify(wrapf(err, "failed to retrieve lock info: %s", err))
 		return lockErr
 	}
 	lockErr.Info = lockInfo
@@ -200,17 +1866,128 @@ func (c *S3Client) Unlock(id string) error {
 		return lockErr
 	}
 
+	// The lock is only deleted if it wasn't replaced since it was read.
+	// Locks taken by older versions have no ID attribute, and were checked
+	// against the ID in Info above.
 	params := &dynamodb.DeleteItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
-			"LockID": {S: aws.String(fmt.Sprintf("%s/%s", c.bucketName, c.keyName))},
+			c.lockKeyName: {S: aws.String(c.LockPath())},
 		},
-		TableName: aws.String(c.lockTable),
+		ConditionExpression: aws.String("attribute_not_exists(ID) OR ID = :id"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":id": {S: aws.String(id)},
+		},
+		TableName:              aws.String(c.lockTable),
+		ReturnConsumedCapacity: c.returnConsumedCapacity(),
 	}
-	_, err = c.dynClient.DeleteItem(params)
+	err = c.retry(ctx, func() error {
+		req, out := c.dynClient.DeleteItemRequest(params)
+		if err := sendOnce(ctx, req); err != nil {
+			return err
+		}
+		logConsumedCapacity("DeleteItem", out.ConsumedCapacity)
+		return nil
+	})
 
 	if err != nil {
-		lockErr.Err = err
+		if isConditionalCheckFailed(err) {
+			err = fmt.Errorf("lock id %q does not match existing lock", id)
+		}
+		lockErr.Err = classifyAction(err, "dynamodb:DeleteItem", c.lockTableResource())
 		return lockErr
 	}
 	return nil
 }
+
+// uploadError describes a failed state upload, explaining the errors S3
+// returns for an ACL when the bucket has ACLs disabled, and for state that
+// already exists or changed since it was read.
+func (c *S3Client) uploadError(err error) error {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "AccessControlListNotSupported":
+			return fmt.Errorf(strings.TrimSpace(errACLNotSupported), err)
+		case "AccessDenied":
+			// Buckets commonly deny unencrypted writes with their policy,
+			// which S3 reports like a missing permission.
+			if !c.serverSideEncryption {
+				err = wrapf(err, strings.TrimSpace(errEncryptionRequired), err)
+				return classifyAction(err, "s3:PutObject", c.StatePath())
+			}
+		case "PreconditionFailed":
+			if c.createOnly {
+				return fmt.Errorf(strings.TrimSpace(errStateExists), c.StatePath(), err)
+			}
+			return &Error{Kind: ErrStateConflict, Err: wrapf(err, strings.TrimSpace(errStateConflict), err)}
+		}
+	}
+	return classifyAction(wrapf(err, "Failed to upload state: %s", err), "s3:PutObject", c.StatePath())
+}
+
+const errBucketRegion = `
+S3 bucket %q is in region %q, not the configured region %q.
+
+Please set the backend's region to %q.
+`
+
+const errACLNotSupported = `
+Failed to upload state: %v
+
+The S3 bucket has ACLs disabled by its "bucket owner enforced" object
+ownership setting, so it rejects the backend's acl. Please remove acl
+from the backend configuration, or set skip_acl to true.
+`
+
+const errEncryptionRequired = `
+Failed to upload state: %s
+
+If the credentials do have s3:PutObject, the bucket policy may deny
+writing objects without server-side encryption, which S3 also reports as
+access denied, since encrypt is false. Please set encrypt to true, and
+kms_key_id if the policy requires SSE-KMS.
+`
+
+const errCustomerKeyRequired = `
+Failed to read remote state: %v
+
+The state object is encrypted with a customer provided key (SSE-C), and S3
+only returns it to requests that include the key. The S3 backend can't send
+a customer key, so it can't read this state. Please re-encrypt the object
+with SSE-S3 or SSE-KMS, for example by copying it over itself with the
+customer key, and set encrypt to true, and kms_key_id for SSE-KMS.
+`
+
+const errStateConflict = `
+Failed to upload state: %s
+
+The state in S3 was changed by someone else since it was last read, so it
+was not overwritten. Please refresh the state and try again. Running
+Terraform concurrently against the same state is only safe with state
+locking, which is enabled by setting lock_table.
+`
+
+const errStateExists = `
+Refusing to overwrite the existing state %s: %v
+
+create_only is set, so state is only written if there is none yet. Please
+check that the backend configuration points to the intended state, or unset
+create_only to replace it.
+`
+
+const errLockTableNotFound = `
+DynamoDB table %q, set as the lock_table, doesn't exist in region %q.
+
+State locking would fail, so the backend can't be used. Please check the
+lock_table name and the region, and that the table has been created. To
+configure the backend without checking the table, set skip_lock_table_check.
+`
+
+const errStateTooSmall = `
+Refusing to upload state of %d bytes, which is smaller than the min_state_bytes
+of %d bytes.
+
+State this small is most likely truncated, and uploading it would replace the
+real state, so that Terraform loses track of the resources it manages. If the
+state really is this small, for example after destroying everything, set
+allow_empty to upload it.
+`
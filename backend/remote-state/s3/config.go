@@ -0,0 +1,147 @@
+package s3
+
+import (
+	"reflect"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Config is the configuration of the backend as a struct, for programs that
+// configure it directly rather than from a terraform block. Each field is the
+// option named by its tag, with the same meaning and validation. Zero fields
+// are left unset, so the option takes its default, which is why the options
+// whose default isn't the zero value are pointers. Durations are strings, as
+// in the configuration, such as "5m".
+type Config struct {
+	Bucket                         string            `mapstructure:"bucket"`
+	Key                            string            `mapstructure:"key"`
+	KeyTemplate                    string            `mapstructure:"key_template"`
+	WorkspaceKeySeparator          string            `mapstructure:"workspace_key_separator"`
+	Region                         string            `mapstructure:"region"`
+	Endpoint                       string            `mapstructure:"endpoint"`
+	Encrypt                        bool              `mapstructure:"encrypt"`
+	UseBucketDefaultEncryption     bool              `mapstructure:"use_bucket_default_encryption"`
+	ACL                            string            `mapstructure:"acl"`
+	RequestPayer                   string            `mapstructure:"request_payer"`
+	ExpectedBucketOwner            string            `mapstructure:"expected_bucket_owner"`
+	BootstrapBucket                bool              `mapstructure:"bootstrap_bucket"`
+	SkipEncryptionCheck            bool              `mapstructure:"skip_encryption_check"`
+	ManageBucketLogging            bool              `mapstructure:"manage_bucket_logging"`
+	LoggingTargetBucket            string            `mapstructure:"logging_target_bucket"`
+	LoggingTargetPrefix            string            `mapstructure:"logging_target_prefix"`
+	SkipACL                        bool              `mapstructure:"skip_acl"`
+	AccessKey                      string            `mapstructure:"access_key"`
+	SecretKey                      string            `mapstructure:"secret_key"`
+	KMSKeyID                       string            `mapstructure:"kms_key_id"`
+	SSEKMSEncryptionContext        map[string]string `mapstructure:"sse_kms_encryption_context"`
+	LockTable                      string            `mapstructure:"lock_table"`
+	DynamoDBKeyName                string            `mapstructure:"dynamodb_key_name"`
+	LockID                         string            `mapstructure:"lock_id"`
+	Profile                        string            `mapstructure:"profile"`
+	SharedCredentialsFile          string            `mapstructure:"shared_credentials_file"`
+	Token                          string            `mapstructure:"token"`
+	RoleARN                        string            `mapstructure:"role_arn"`
+	AssumeRoleDurationSeconds      int               `mapstructure:"assume_role_duration_seconds"`
+	SerialNumber                   string            `mapstructure:"serial_number"`
+	TokenCode                      string            `mapstructure:"token_code"`
+	SourceRoleARN                  string            `mapstructure:"source_role_arn"`
+	STSEndpoint                    string            `mapstructure:"sts_endpoint"`
+	DynamoDBConsistentRead         *bool             `mapstructure:"dynamodb_consistent_read"`
+	LockTimeout                    string            `mapstructure:"lock_timeout"`
+	OperationTimeout               string            `mapstructure:"operation_timeout"`
+	LockPollInterval               string            `mapstructure:"lock_poll_interval"`
+	LockMaxAttempts                int               `mapstructure:"lock_max_attempts"`
+	DebugConsumedCapacity          bool              `mapstructure:"debug_consumed_capacity"`
+	LockTTL                        string            `mapstructure:"lock_ttl"`
+	ChecksumAlgorithm              string            `mapstructure:"checksum_algorithm"`
+	ContentType                    string            `mapstructure:"content_type"`
+	Metadata                       map[string]string `mapstructure:"metadata"`
+	OptimisticLocking              bool              `mapstructure:"optimistic_locking"`
+	ConflictRetry                  int               `mapstructure:"conflict_retry"`
+	CreateOnly                     bool              `mapstructure:"create_only"`
+	Compress                       bool              `mapstructure:"compress"`
+	CacheControl                   string            `mapstructure:"cache_control"`
+	ObjectExpires                  string            `mapstructure:"object_expires"`
+	ObjectLockMode                 string            `mapstructure:"object_lock_mode"`
+	ObjectLockRetainUntilDays      int               `mapstructure:"object_lock_retain_until_days"`
+	ReplicaRegion                  string            `mapstructure:"replica_region"`
+	ReplicaBucket                  string            `mapstructure:"replica_bucket"`
+	RequireVersioning              bool              `mapstructure:"require_versioning"`
+	SoftDelete                     bool              `mapstructure:"soft_delete"`
+	SoftDeleteRetention            string            `mapstructure:"soft_delete_retention"`
+	WriteBackup                    bool              `mapstructure:"write_backup"`
+	PurgeVersions                  bool              `mapstructure:"purge_versions"`
+	MinStateBytes                  int               `mapstructure:"min_state_bytes"`
+	AllowEmpty                     bool              `mapstructure:"allow_empty"`
+	DryRun                         bool              `mapstructure:"dry_run"`
+	MaxRetries                     *int              `mapstructure:"max_retries"`
+	Insecure                       bool              `mapstructure:"insecure"`
+	MinTLSVersion                  string            `mapstructure:"min_tls_version"`
+	CABundle                       string            `mapstructure:"ca_bundle"`
+	UserAgentSuffix                string            `mapstructure:"user_agent_suffix"`
+	HTTPClientTimeout              string            `mapstructure:"http_client_timeout"`
+	DialTimeout                    string            `mapstructure:"dial_timeout"`
+	ResponseHeaderTimeout          string            `mapstructure:"response_header_timeout"`
+	HTTPProxy                      string            `mapstructure:"http_proxy"`
+	UseFIPSEndpoint                bool              `mapstructure:"use_fips_endpoint"`
+	UseDualStackEndpoint           bool              `mapstructure:"use_dualstack_endpoint"`
+	ForcePathStyle                 bool              `mapstructure:"force_path_style"`
+	Accelerate                     bool              `mapstructure:"accelerate"`
+	SkipBucketValidation           bool              `mapstructure:"skip_bucket_validation"`
+	SkipLockTableCheck             bool              `mapstructure:"skip_lock_table_check"`
+	EC2MetadataServiceEndpointMode string            `mapstructure:"ec2_metadata_service_endpoint_mode"`
+	EC2MetadataEnableFallback      bool              `mapstructure:"ec2_metadata_enable_fallback"`
+	WebIdentityTokenFile           string            `mapstructure:"web_identity_token_file"`
+	CredentialProcess              string            `mapstructure:"credential_process"`
+	CacheCredentials               bool              `mapstructure:"cache_credentials"`
+}
+
+// NewWithConfig creates a backend for S3 remote state configured with cfg.
+// The config is validated and applied just as a terraform block with the same
+// options would be.
+func NewWithConfig(cfg Config) (*Backend, error) {
+	rc, err := config.NewRawConfig(cfg.raw())
+	if err != nil {
+		return nil, err
+	}
+	conf := terraform.NewResourceConfig(rc)
+
+	b := New().(*Backend)
+	if _, errs := b.Validate(conf); len(errs) > 0 {
+		return nil, multierror.Append(nil, errs...)
+	}
+	if err := b.Configure(conf); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// raw returns the options set in cfg, as the map a terraform block decodes
+// to.
+func (cfg Config) raw() map[string]interface{} {
+	raw := make(map[string]interface{})
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("mapstructure")
+		f := v.Field(i)
+		if reflect.DeepEqual(f.Interface(), reflect.Zero(f.Type()).Interface()) {
+			continue
+		}
+
+		switch f.Kind() {
+		case reflect.Ptr:
+			raw[name] = f.Elem().Interface()
+		case reflect.Map:
+			m := make(map[string]interface{}, f.Len())
+			for _, k := range f.MapKeys() {
+				m[k.String()] = f.MapIndex(k).String()
+			}
+			raw[name] = m
+		default:
+			raw[name] = f.Interface()
+		}
+	}
+	return raw
+}
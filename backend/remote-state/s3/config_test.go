@@ -0,0 +1,84 @@
+package s3
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestNewWithConfig(t *testing.T) {
+	b, err := NewWithConfig(Config{
+		Bucket:                 "tf-test",
+		Key:                    "state",
+		Region:                 "us-west-1",
+		AccessKey:              "ACCESS_KEY",
+		SecretKey:              "SECRET_KEY",
+		LockTable:              "tf-lock",
+		LockTimeout:            "30s",
+		DynamoDBConsistentRead: aws.Bool(false),
+		MaxRetries:             aws.Int(0),
+		Metadata:               map[string]string{"team": "infra"},
+		SkipBucketValidation:   true,
+		SkipLockTableCheck:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := b.client
+	if client.bucketName != "tf-test" || client.keyName != "state" || client.lockTable != "tf-lock" {
+		t.Fatalf("unexpected client config: %s/%s, lock table %q", client.bucketName, client.keyName, client.lockTable)
+	}
+	if client.lockTimeout != 30*time.Second {
+		t.Fatalf("expected lock timeout of 30s, got %s", client.lockTimeout)
+	}
+	if client.consistentRead {
+		t.Fatal("expected an explicit false dynamodb_consistent_read to be applied")
+	}
+	if client.maxRetries != 0 {
+		t.Fatalf("expected an explicit max_retries of 0, got %d", client.maxRetries)
+	}
+	if client.metadata["team"] == nil || *client.metadata["team"] != "infra" {
+		t.Fatalf("expected metadata to be applied, got %v", client.metadata)
+	}
+
+	// Unset options take their defaults.
+	if client.lockKeyName != "LockID" {
+		t.Fatalf("expected the default dynamodb_key_name, got %q", client.lockKeyName)
+	}
+	if client.cacheControl != "no-store" {
+		t.Fatalf("expected the default cache_control, got %q", client.cacheControl)
+	}
+}
+
+func TestNewWithConfig_invalid(t *testing.T) {
+	_, err := NewWithConfig(Config{
+		Bucket:      "tf-test",
+		Key:         "state",
+		Region:      "us-west-1",
+		LockTimeout: "thirty seconds",
+	})
+	if err == nil {
+		t.Fatal("expected an invalid lock_timeout to fail")
+	}
+}
+
+func TestConfigFields(t *testing.T) {
+	fields := make(map[string]bool)
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		fields[typ.Field(i).Tag.Get("mapstructure")] = true
+	}
+
+	for name := range New().(*Backend).Schema {
+		if !fields[name] {
+			t.Errorf("Config has no field for the %q option", name)
+		}
+		delete(fields, name)
+	}
+	for name := range fields {
+		t.Errorf("Config has a field for %q, which isn't an option", name)
+	}
+}
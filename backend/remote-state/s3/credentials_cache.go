@@ -0,0 +1,103 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	terraformAWS "github.com/hashicorp/terraform/builtin/providers/aws"
+)
+
+// getCredentials resolves the credential chain of a backend. It's a variable
+// so tests can count how often credentials are resolved.
+var getCredentials = terraformAWS.GetCredentials
+
+// sharedCredentials holds the credentials of backends configured with
+// cache_credentials, so backends in the same process with the same
+// credential settings don't each assume the role again.
+var sharedCredentials = newCredentialsCache()
+
+// credentialsCache memoizes resolved credentials by the settings they were
+// resolved from. The credentials refresh themselves once they expire, so
+// entries are kept for the life of the process.
+type credentialsCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedCredentials
+}
+
+// cachedCredentials has its own lock, so that concurrent backends with the
+// same settings wait for a single resolution, without blocking backends with
+// other settings.
+type cachedCredentials struct {
+	mu    sync.Mutex
+	creds *credentials.Credentials
+}
+
+func newCredentialsCache() *credentialsCache {
+	return &credentialsCache{entries: make(map[string]*cachedCredentials)}
+}
+
+// get returns the cached credentials for config, resolving them if they
+// haven't been yet. Errors aren't cached, so a later backend tries again.
+// Configs with an MFA token provider aren't cached, since the provider can't
+// be compared.
+func (c *credentialsCache) get(config *terraformAWS.Config) (*credentials.Credentials, error) {
+	if config.AssumeRoleTokenProvider != nil {
+		return getCredentials(config)
+	}
+
+	key := credentialsKey(config)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cachedCredentials{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.creds == nil {
+		creds, err := getCredentials(config)
+		if err != nil {
+			return nil, err
+		}
+		entry.creds = creds
+	}
+	return entry.creds, nil
+}
+
+// credentialsKey identifies the credential settings of config: the settings
+// GetCredentials resolves credentials from, and nothing else. It's hashed so
+// the cache doesn't keep the secrets in its keys.
+func credentialsKey(config *terraformAWS.Config) string {
+	settings := []string{
+		config.AccessKey,
+		config.SecretKey,
+		config.Token,
+		config.Profile,
+		config.CredsFilename,
+		config.AssumeRoleARN,
+		config.AssumeRoleSessionName,
+		config.AssumeRoleExternalID,
+		config.AssumeRolePolicy,
+		config.AssumeRoleSourceARN,
+		config.AssumeRoleDuration.String(),
+		config.AssumeRoleSerialNumber,
+		config.AssumeRoleTokenCode,
+		config.CredentialProcess,
+		config.WebIdentityTokenFile,
+		config.Region,
+		config.StsEndpoint,
+		config.Ec2MetadataServiceEndpointMode,
+		strconv.FormatBool(config.Ec2MetadataDisableFallback),
+		strconv.FormatBool(config.SkipMetadataApiCheck),
+		strconv.Itoa(config.MaxRetries),
+	}
+	// Quoting keeps the settings apart, whatever they contain.
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%q", settings))))
+}
@@ -0,0 +1,162 @@
+package s3
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/hashicorp/terraform/backend"
+	terraformAWS "github.com/hashicorp/terraform/builtin/providers/aws"
+)
+
+// stubAssumeRole replaces the credential resolution with one that counts the
+// calls that would have been made to STS to assume the role.
+func stubAssumeRole() (stsCalls *int32, restore func()) {
+	stsCalls = new(int32)
+	oldGet, oldShared := getCredentials, sharedCredentials
+	getCredentials = func(c *terraformAWS.Config) (*credentials.Credentials, error) {
+		creds := credentials.NewCredentials(&countingProvider{calls: stsCalls, role: c.AssumeRoleARN})
+		// Like GetCredentials, assume the role right away to check it.
+		if _, err := creds.Get(); err != nil {
+			return nil, err
+		}
+		return creds, nil
+	}
+	sharedCredentials = newCredentialsCache()
+	return stsCalls, func() {
+		getCredentials, sharedCredentials = oldGet, oldShared
+	}
+}
+
+type countingProvider struct {
+	calls *int32
+	role  string
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	atomic.AddInt32(p.calls, 1)
+	return credentials.Value{
+		AccessKeyID:     "ROLE_KEY",
+		SecretAccessKey: "ROLE_SECRET",
+		SessionToken:    p.role,
+	}, nil
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return false
+}
+
+func TestBackendConfig_cacheCredentials(t *testing.T) {
+	stsCalls, restore := stubAssumeRole()
+	defer restore()
+
+	config := func(role string, cache bool) map[string]interface{} {
+		return map[string]interface{}{
+			"region":                 "us-west-1",
+			"bucket":                 "tf-test",
+			"key":                    "state",
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+			"role_arn":               role,
+			"cache_credentials":      cache,
+			"skip_bucket_validation": true,
+		}
+	}
+
+	b1 := backend.TestBackendConfig(t, New(), config("arn:aws:iam::123456789012:role/a", true)).(*Backend)
+	b2 := backend.TestBackendConfig(t, New(), config("arn:aws:iam::123456789012:role/a", true)).(*Backend)
+	if n := atomic.LoadInt32(stsCalls); n != 1 {
+		t.Fatalf("expected backends with the same config to share one STS call, got %d", n)
+	}
+	if b1.client.nativeClient.Config.Credentials != b2.client.nativeClient.Config.Credentials {
+		t.Fatal("expected backends with the same config to share credentials")
+	}
+
+	// Other credential settings resolve their own credentials.
+	b3 := backend.TestBackendConfig(t, New(), config("arn:aws:iam::123456789012:role/b", true)).(*Backend)
+	if n := atomic.LoadInt32(stsCalls); n != 2 {
+		t.Fatalf("expected another role to be assumed separately, got %d STS calls", n)
+	}
+	v, err := b3.client.nativeClient.Config.Credentials.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.SessionToken != "arn:aws:iam::123456789012:role/b" {
+		t.Fatalf("got the credentials of another role: %q", v.SessionToken)
+	}
+
+	// Without cache_credentials every backend assumes the role.
+	backend.TestBackendConfig(t, New(), config("arn:aws:iam::123456789012:role/a", false))
+	if n := atomic.LoadInt32(stsCalls); n != 3 {
+		t.Fatalf("expected an uncached backend to assume the role, got %d STS calls", n)
+	}
+}
+
+func TestCredentialsCacheConcurrent(t *testing.T) {
+	stsCalls, restore := stubAssumeRole()
+	defer restore()
+
+	config := &terraformAWS.Config{
+		AccessKey:     "ACCESS_KEY",
+		SecretKey:     "SECRET_KEY",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/a",
+	}
+
+	results := make([]*credentials.Credentials, 10)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			creds, err := sharedCredentials.get(config)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = creds
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(stsCalls); n != 1 {
+		t.Fatalf("expected one STS call, got %d", n)
+	}
+	for _, creds := range results {
+		if creds != results[0] {
+			t.Fatal("expected every caller to get the same credentials")
+		}
+	}
+}
+
+func TestCredentialsKey(t *testing.T) {
+	base := terraformAWS.Config{
+		AccessKey:     "ACCESS_KEY",
+		SecretKey:     "SECRET_KEY",
+		AssumeRoleARN: "arn:aws:iam::123456789012:role/a",
+		Region:        "us-west-1",
+	}
+	key := credentialsKey(&base)
+
+	// Settings that don't change the credentials don't change the key.
+	other := base
+	other.AllowedAccountIds = []interface{}{"123456789012"}
+	other.ForbiddenAccountIds = []interface{}{"210987654321"}
+	other.S3Endpoint = "https://s3.example.com"
+	if got := credentialsKey(&other); got != key {
+		t.Fatal("expected settings other than credentials to be ignored")
+	}
+
+	for name, change := range map[string]func(*terraformAWS.Config){
+		"secret key":   func(c *terraformAWS.Config) { c.SecretKey = "OTHER_SECRET" },
+		"role":         func(c *terraformAWS.Config) { c.AssumeRoleARN = "arn:aws:iam::123456789012:role/b" },
+		"region":       func(c *terraformAWS.Config) { c.Region = "us-east-1" },
+		"sts endpoint": func(c *terraformAWS.Config) { c.StsEndpoint = "https://sts.example.com" },
+		"fields split": func(c *terraformAWS.Config) { c.AccessKey, c.SecretKey = "ACCESS_KEYSECRET", "_KEY" },
+	} {
+		other := base
+		change(&other)
+		if credentialsKey(&other) == key {
+			t.Fatalf("%s: expected a different key", name)
+		}
+	}
+}
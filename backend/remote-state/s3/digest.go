@@ -0,0 +1,171 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// With checksum_algorithm set to SHA256, the SHA256 checksum of the state
+// object is also stored in the lock table, in an item keyed by the state path
+// with digestSuffix. Reads ask S3 for the checksum it stored with the object
+// and compare both to the object read, so state that was changed or damaged
+// anywhere between the write and the read is detected.
+
+const digestSuffix = "-sha256"
+
+// headerChecksumSHA256 is the SHA256 checksum S3 returns with an object when
+// headerChecksumMode is ENABLED. The SDK has no fields for them.
+const (
+	headerChecksumSHA256 = "X-Amz-Checksum-Sha256"
+	headerChecksumMode   = "X-Amz-Checksum-Mode"
+)
+
+const errBadChecksum = `state data in S3 does not have the expected content.
+
+The SHA256 checksum of the state read from S3 is %s, but the checksum %s
+is %s. The state may have been changed outside of Terraform, or damaged on
+the way. If the state object is correct, delete the %q item from the %q
+DynamoDB table, or write the state again, to update the stored checksum.
+`
+
+// verifiesChecksum reports whether state reads are checked against the
+// SHA256 checksums stored when the state was written.
+func (c *S3Client) verifiesChecksum() bool {
+	return c.checksumAlgorithm == "SHA256"
+}
+
+// digestPath returns the key of the lock table item holding the checksum of
+// the state.
+func (c *S3Client) digestPath() string {
+	return c.StatePath() + digestSuffix
+}
+
+// enableChecksumMode is a Build handler that asks S3 to return the checksum
+// stored with the object.
+func enableChecksumMode(r *request.Request) {
+	r.HTTPRequest.Header.Set(headerChecksumMode, "ENABLED")
+}
+
+// verifyChecksum checks data, the state object as read from S3, against the
+// checksum S3 returned with it in s3Sum, and, if it's the current version, the
+// one stored in the lock table. Either may be missing, for state written
+// before checksums were stored or with a multipart upload.
+func (c *S3Client) verifyChecksum(ctx context.Context, data []byte, s3Sum string, current bool) error {
+	_, sum, err := checksum("SHA256", data)
+	if err != nil {
+		return err
+	}
+
+	// Multipart objects have a checksum of their parts' checksums, with a
+	// part count suffix, which can't be compared.
+	if s3Sum != "" && !strings.Contains(s3Sum, "-") && s3Sum != sum {
+		return fmt.Errorf(errBadChecksum, sum, "S3 stored with the object", s3Sum, c.digestPath(), c.lockTable)
+	}
+
+	if c.lockTable == "" || !current {
+		return nil
+	}
+	stored, err := c.getDigest(ctx)
+	if err != nil {
+		return fmt.Errorf("Error reading state checksum from DynamoDB: %s", err)
+	}
+	if stored != "" && stored != sum {
+		return fmt.Errorf(errBadChecksum, sum, "stored in DynamoDB", stored, c.digestPath(), c.lockTable)
+	}
+	return nil
+}
+
+// getDigest returns the stored checksum of the state, or an empty string if
+// there is none.
+func (c *S3Client) getDigest(ctx context.Context) (string, error) {
+	var resp *dynamodb.GetItemOutput
+	err := c.retry(ctx, func() error {
+		var req *request.Request
+		req, resp = c.dynClient.GetItemRequest(&dynamodb.GetItemInput{
+			Key: map[string]*dynamodb.AttributeValue{
+				c.lockKeyName: {S: aws.String(c.digestPath())},
+			},
+			ProjectionExpression: aws.String("Digest"),
+			TableName:            aws.String(c.lockTable),
+			ConsistentRead:       aws.Bool(true),
+		})
+		return sendOnce(ctx, req)
+	})
+	if err != nil {
+		return "", classify(err)
+	}
+	if v, ok := resp.Item["Digest"]; ok && v.S != nil {
+		return *v.S, nil
+	}
+	return "", nil
+}
+
+// storeDigest stores the checksum of data, the state that was written, when
+// there's a lock table to store it in. It's stored even when checksums
+// aren't verified, so that a later verifying read doesn't find the checksum
+// of older state.
+func (c *S3Client) storeDigest(ctx context.Context, data []byte) error {
+	if c.lockTable == "" {
+		return nil
+	}
+
+	_, sum, err := checksum("SHA256", data)
+	if err != nil {
+		return err
+	}
+	if err := c.putDigest(ctx, sum); err != nil {
+		return fmt.Errorf("Error storing state checksum in DynamoDB: %s", err)
+	}
+	return nil
+}
+
+// copyDigest stores the checksum of the state for its copy at key, when
+// there's a lock table to store it in. Without a checksum for the state, one
+// left at key is removed.
+func (c *S3Client) copyDigest(ctx context.Context, key string) error {
+	if c.lockTable == "" {
+		return nil
+	}
+
+	sum, err := c.getDigest(ctx)
+	if err != nil {
+		return fmt.Errorf("Error reading state checksum from DynamoDB: %s", err)
+	}
+	dst := *c
+	dst.keyName = key
+	if err := dst.putDigest(ctx, sum); err != nil {
+		return fmt.Errorf("Error storing state checksum in DynamoDB: %s", err)
+	}
+	return nil
+}
+
+// putDigest stores the checksum of the state that was written. An empty sum
+// removes it.
+func (c *S3Client) putDigest(ctx context.Context, sum string) error {
+	key := map[string]*dynamodb.AttributeValue{
+		c.lockKeyName: {S: aws.String(c.digestPath())},
+	}
+
+	err := c.retry(ctx, func() error {
+		var req *request.Request
+		if sum == "" {
+			req, _ = c.dynClient.DeleteItemRequest(&dynamodb.DeleteItemInput{
+				Key:       key,
+				TableName: aws.String(c.lockTable),
+			})
+		} else {
+			key["Digest"] = &dynamodb.AttributeValue{S: aws.String(sum)}
+			req, _ = c.dynClient.PutItemRequest(&dynamodb.PutItemInput{
+				Item:      key,
+				TableName: aws.String(c.lockTable),
+			})
+		}
+		return sendOnce(ctx, req)
+	})
+	return classify(err)
+}
@@ -0,0 +1,189 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestRemoteClientChecksumRoundTrip(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.checksumAlgorithm = "SHA256"
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sum, _ := checksum("SHA256", []byte("test state"))
+	put := stub.requests("PutObject")[0].HTTPRequest.Header
+	if got := put.Get("X-Amz-Checksum-Sha256"); got != sum {
+		t.Fatalf("expected ChecksumSHA256 %q, got %q", sum, got)
+	}
+	digest := stub.items["tf-test/state-sha256"]
+	if got := aws.StringValue(digest["Digest"].S); got != sum {
+		t.Fatalf("expected stored digest %q, got %q", sum, got)
+	}
+
+	p, err := c.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "test state" {
+		t.Fatalf("bad state: %q", p.Data)
+	}
+	get := stub.requests("GetObject")[0].HTTPRequest.Header
+	if got := get.Get("X-Amz-Checksum-Mode"); got != "ENABLED" {
+		t.Fatalf("expected checksum mode to be enabled, got %q", got)
+	}
+
+	// Deleting the state removes the digest, so a new state can be read.
+	if err := c.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.items["tf-test/state-sha256"]; ok {
+		t.Fatal("digest was not removed with the state")
+	}
+}
+
+func TestRemoteClientChecksumMove(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.checksumAlgorithm = "SHA256"
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	// A checksum left at the new path by other state is replaced.
+	stub.items["tf-test/moved-sha256"] = map[string]*dynamodb.AttributeValue{
+		"LockID": {S: aws.String("tf-test/moved-sha256")},
+		"Digest": {S: aws.String("other")},
+	}
+
+	if err := c.Move("moved", true); err != nil {
+		t.Fatal(err)
+	}
+
+	_, sum, _ := checksum("SHA256", []byte("test state"))
+	if _, ok := stub.items["tf-test/state-sha256"]; ok {
+		t.Fatal("digest wasn't removed from the old path")
+	}
+	if got := aws.StringValue(stub.items["tf-test/moved-sha256"]["Digest"].S); got != sum {
+		t.Fatalf("expected digest %q at the new path, got %q", sum, got)
+	}
+
+	// The moved state reads back, and new state at the old path too.
+	if _, err := c.Get(); err != nil {
+		t.Fatal(err)
+	}
+	old := stub.client()
+	old.checksumAlgorithm = "SHA256"
+	if err := old.Put([]byte("new state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteClientChecksumMismatch(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.checksumAlgorithm = "SHA256"
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+
+	// S3 detects the object was changed after it was written.
+	stub.objects["state"] = []byte("changed state")
+	_, err := c.Get()
+	if err == nil || !strings.Contains(err.Error(), "S3 stored with the object") {
+		t.Fatalf("expected an S3 checksum mismatch, got %v", err)
+	}
+
+	// The stored digest catches an object S3 has no checksum for, such as
+	// one replaced without a checksum.
+	delete(stub.checksums, "state")
+	_, err = c.Get()
+	if err == nil || !strings.Contains(err.Error(), "stored in DynamoDB") {
+		t.Fatalf("expected a stored checksum mismatch, got %v", err)
+	}
+
+	// A mismatched digest is detected too.
+	stub.objects["state"] = []byte("test state")
+	stub.items["tf-test/state-sha256"]["Digest"] = &dynamodb.AttributeValue{S: aws.String("bad")}
+	_, err = c.Get()
+	if err == nil || !strings.Contains(err.Error(), "stored in DynamoDB") {
+		t.Fatalf("expected a stored checksum mismatch, got %v", err)
+	}
+
+	// Writing the state again updates the digest.
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteClientChecksumWithoutLockTable(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.checksumAlgorithm = "SHA256"
+	c.lockTable = ""
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.requests("PutItem")) + len(stub.requests("GetItem")); n != 0 {
+		t.Fatalf("expected no DynamoDB requests without a lock table, got %d", n)
+	}
+
+	stub.objects["state"] = []byte("changed state")
+	if _, err := c.Get(); err == nil {
+		t.Fatal("expected an S3 checksum mismatch")
+	}
+}
+
+func TestRemoteClientChecksumOtherAlgorithm(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.checksumAlgorithm = "CRC32"
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(); err != nil {
+		t.Fatal(err)
+	}
+	// The checksum is stored even though it isn't verified, so a later
+	// verifying read doesn't compare against an older one.
+	if _, ok := stub.items["tf-test/state-sha256"]; !ok {
+		t.Fatalf("expected the digest to be stored, got %v", stub.items)
+	}
+	if got := stub.requests("GetObject")[0].HTTPRequest.Header.Get("X-Amz-Checksum-Mode"); got != "" {
+		t.Fatalf("expected no checksum mode, got %q", got)
+	}
+}
+
+func TestRemoteClientChecksumDeletedUnverified(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.checksumAlgorithm = ""
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.items["tf-test/state-sha256"]; ok {
+		t.Fatal("digest wasn't deleted with the state")
+	}
+}
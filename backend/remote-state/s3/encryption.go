@@ -0,0 +1,120 @@
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// The vendored SDK predates default bucket encryption, so the
+// GetBucketEncryption operation is defined here, with only the fields that
+// are used. PutBucketEncryption is defined with the bucket bootstrap.
+
+const opGetBucketEncryption = "GetBucketEncryption"
+
+type getBucketEncryptionInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+}
+
+type getBucketEncryptionOutput struct {
+	_ struct{} `type:"structure" payload:"ServerSideEncryptionConfiguration"`
+
+	ServerSideEncryptionConfiguration *serverSideEncryptionConfiguration `type:"structure"`
+}
+
+type serverSideEncryptionConfiguration struct {
+	_ struct{} `type:"structure"`
+
+	Rules []*serverSideEncryptionRule `locationName:"Rule" type:"list" flattened:"true"`
+}
+
+type serverSideEncryptionRule struct {
+	_ struct{} `type:"structure"`
+
+	ApplyServerSideEncryptionByDefault *serverSideEncryptionByDefault `type:"structure"`
+}
+
+type serverSideEncryptionByDefault struct {
+	_ struct{} `type:"structure"`
+
+	KMSMasterKeyID *string `type:"string"`
+	SSEAlgorithm   *string `type:"string"`
+}
+
+// errCodeNoBucketEncryption is returned by GetBucketEncryption for buckets
+// without default encryption.
+const errCodeNoBucketEncryption = "ServerSideEncryptionConfigurationNotFoundError"
+
+// defaultEncryption returns the default encryption algorithm of the bucket,
+// or an empty string if objects aren't encrypted by default.
+func (c *S3Client) defaultEncryption() (string, error) {
+	output := &getBucketEncryptionOutput{}
+	req := c.nativeClient.NewRequest(&request.Operation{
+		Name:       opGetBucketEncryption,
+		HTTPMethod: "GET",
+		HTTPPath:   "/{Bucket}?encryption",
+	}, &getBucketEncryptionInput{Bucket: &c.bucketName}, output)
+
+	if err := req.Send(); err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == errCodeNoBucketEncryption {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if config := output.ServerSideEncryptionConfiguration; config != nil {
+		for _, rule := range config.Rules {
+			if rule.ApplyServerSideEncryptionByDefault != nil {
+				return aws.StringValue(rule.ApplyServerSideEncryptionByDefault.SSEAlgorithm), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// warnUnencrypted logs a warning if the bucket doesn't encrypt objects by
+// default, for when encrypt is false. The check is best effort, since the
+// credentials may not be allowed to read the bucket's encryption.
+func (c *S3Client) warnUnencrypted() {
+	algorithm, err := c.defaultEncryption()
+	if err != nil {
+		log.Printf("[DEBUG] Unable to check the default encryption of S3 bucket %q: %s", c.bucketName, err)
+		return
+	}
+	if algorithm == "" {
+		log.Printf("[WARN] encrypt is false and S3 bucket %q has no default encryption, so state will be stored unencrypted", c.bucketName)
+		return
+	}
+	log.Printf("[DEBUG] S3 bucket %q encrypts objects with %s by default", c.bucketName, algorithm)
+}
+
+// encodeEncryptionContext encodes an SSE-KMS encryption context as S3 expects
+// it, base64 encoded JSON.
+func encodeEncryptionContext(context map[string]interface{}) (string, error) {
+	values := make(map[string]string, len(context))
+	for k, v := range context {
+		values[k] = v.(string)
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// setEncryptionContext is a Build handler that sets the SSE-KMS encryption
+// context of the state object being written, for KMS key policies that
+// require one. The SDK has no field for it. S3 stores the context with the
+// object, so it isn't needed to read it.
+func (c *S3Client) setEncryptionContext(r *request.Request) {
+	if c.kmsEncryptionContext == "" {
+		return
+	}
+	r.HTTPRequest.Header.Set("X-Amz-Server-Side-Encryption-Context", c.kmsEncryptionContext)
+}
@@ -0,0 +1,188 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/terraform/backend"
+)
+
+func TestRemoteClientDefaultEncryption(t *testing.T) {
+	var encrypted bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["encryption"]; r.URL.Path != "/tf-test" || !ok {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if !encrypted {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>ServerSideEncryptionConfigurationNotFoundError</Code><Message>not found</Message></Error>`)
+			return
+		}
+		fmt.Fprint(w, `<ServerSideEncryptionConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">
+  <Rule>
+    <ApplyServerSideEncryptionByDefault>
+      <SSEAlgorithm>aws:kms</SSEAlgorithm>
+    </ApplyServerSideEncryptionByDefault>
+  </Rule>
+</ServerSideEncryptionConfiguration>`)
+	}))
+	defer ts.Close()
+
+	c := &S3Client{
+		nativeClient: s3.New(session.New(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("ACCESS_KEY", "SECRET_KEY", ""),
+			Region:           aws.String("us-west-2"),
+			Endpoint:         aws.String(ts.URL),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		})),
+		bucketName: "tf-test",
+	}
+
+	algorithm, err := c.defaultEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "" {
+		t.Fatalf("expected no default encryption, got %q", algorithm)
+	}
+
+	encrypted = true
+	algorithm, err = c.defaultEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algorithm != "aws:kms" {
+		t.Fatalf("expected aws:kms default encryption, got %q", algorithm)
+	}
+}
+
+func TestRemoteClientWarnUnencrypted(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	stub.handlers[opGetBucketEncryption] = func(r *request.Request) {
+		stubError(r, http.StatusNotFound, errCodeNoBucketEncryption)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c.warnUnencrypted()
+	if !strings.Contains(buf.String(), "[WARN] encrypt is false and S3 bucket \"tf-test\" has no default encryption") {
+		t.Fatalf("expected a warning, got: %s", buf.String())
+	}
+	if n := len(stub.requests(opGetBucketEncryption)); n != 1 {
+		t.Fatalf("expected 1 GetBucketEncryption call, got %d", n)
+	}
+}
+
+func TestBackendConfig_kmsEncryptionContext(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"encrypt":                true,
+		"kms_key_id":             "arn:aws:kms:us-west-1:123456789012:key/test",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"sse_kms_encryption_context": map[string]interface{}{
+			"team":    "platform",
+			"purpose": "terraform-state",
+		},
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.client.Move("moved", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.client.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := base64.StdEncoding.EncodeToString([]byte(`{"purpose":"terraform-state","team":"platform"}`))
+	for _, op := range []string{"PutObject", "CopyObject"} {
+		r := stub.requests(op)[0]
+		if got := r.HTTPRequest.Header.Get("X-Amz-Server-Side-Encryption-Context"); got != want {
+			t.Fatalf("%s: expected encryption context %q, got %q", op, want, got)
+		}
+		if got := r.HTTPRequest.Header.Get("X-Amz-Server-Side-Encryption"); got != "aws:kms" {
+			t.Fatalf("%s: expected SSE-KMS, got %q", op, got)
+		}
+	}
+	if got := stub.requests("GetObject")[0].HTTPRequest.Header.Get("X-Amz-Server-Side-Encryption-Context"); got != "" {
+		t.Fatalf("expected no encryption context on reads, got %q", got)
+	}
+
+	// The context is only used with a KMS key.
+	delete(config, "kms_key_id")
+	err := testBackendConfigErr(t, config)
+	if err == nil || !strings.Contains(err.Error(), "sse_kms_encryption_context") {
+		t.Fatalf("expected an error about sse_kms_encryption_context, got %v", err)
+	}
+}
+
+func TestRemoteClientUseBucketDefaultEncryption(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.serverSideEncryption = true
+	c.bucketEncryption = true
+	c.writeBackup = true
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"PutObject", "CopyObject"} {
+		r := stub.requests(op)[0]
+		if h := r.HTTPRequest.Header.Get("X-Amz-Server-Side-Encryption"); h != "" {
+			t.Fatalf("%s: expected no server-side encryption header, got %q", op, h)
+		}
+	}
+
+	// Without the option, encrypt sends AES256.
+	c.bucketEncryption = false
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	r := stub.requests("PutObject")[1]
+	if h := r.HTTPRequest.Header.Get("X-Amz-Server-Side-Encryption"); h != "AES256" {
+		t.Fatalf("expected AES256 server-side encryption, got %q", h)
+	}
+}
+
+func TestBackendConfig_useBucketDefaultEncryption(t *testing.T) {
+	for name, config := range map[string]map[string]interface{}{
+		"without encrypt": {},
+		"with kms_key_id": {
+			"encrypt":    true,
+			"kms_key_id": "arn:aws:kms:us-west-1:123456789012:key/test",
+		},
+	} {
+		config["region"] = "us-west-1"
+		config["bucket"] = "tf-test"
+		config["key"] = "state"
+		config["use_bucket_default_encryption"] = true
+		if err := testBackendConfigErr(t, config); err == nil || !strings.Contains(err.Error(), "use_bucket_default_encryption") {
+			t.Fatalf("%s: expected an error, got %v", name, err)
+		}
+	}
+}
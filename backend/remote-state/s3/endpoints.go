@@ -0,0 +1,84 @@
+package s3
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// fipsResolver resolves the FIPS 140-2 endpoints of services, which are
+// named service-fips.region. The vendored SDK predates FIPS endpoint
+// resolution, so the signing information is resolved as usual, and only the
+// URL is replaced.
+func fipsResolver(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+	resolved, err := endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+	if err != nil {
+		return resolved, err
+	}
+
+	resolved.URL = fmt.Sprintf("https://%s-fips.%s.%s", service, region, dnsSuffix(region))
+	return resolved, nil
+}
+
+// regionPartition returns the ID of the partition of region, matching the
+// region patterns of the SDK's partitions.
+func regionPartition(region string) string {
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return endpoints.AwsUsGovPartitionID
+	case strings.HasPrefix(region, "cn-"):
+		return endpoints.AwsCnPartitionID
+	default:
+		return endpoints.AwsPartitionID
+	}
+}
+
+// dnsSuffix returns the domain of the endpoints in region's partition.
+func dnsSuffix(region string) string {
+	if regionPartition(region) == endpoints.AwsCnPartitionID {
+		return "amazonaws.com.cn"
+	}
+	return "amazonaws.com"
+}
+
+// endpointPartition returns the ID of the partition of an AWS endpoint, or
+// false if it isn't an AWS endpoint, such as that of an S3 compatible
+// service.
+func endpointPartition(endpoint string) (string, bool) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.HasSuffix(host, ".amazonaws.com.cn"):
+		return endpoints.AwsCnPartitionID, true
+	case strings.HasSuffix(host, ".amazonaws.com"):
+		if strings.Contains(host, "us-gov-") {
+			return endpoints.AwsUsGovPartitionID, true
+		}
+		return endpoints.AwsPartitionID, true
+	default:
+		return "", false
+	}
+}
+
+// warnEndpointPartition logs a warning if endpoint is an AWS endpoint in
+// another partition than region, which fails with signing errors that don't
+// point to the cause.
+func warnEndpointPartition(endpoint, region string) {
+	partition, ok := endpointPartition(endpoint)
+	if !ok || partition == regionPartition(region) {
+		return
+	}
+	log.Printf("[WARN] The endpoint %q is in the %s partition, but region %q is in the %s partition, "+
+		"so requests will fail to authenticate. Please remove the endpoint, or use one in the %s partition.",
+		endpoint, partition, region, regionPartition(region), regionPartition(region))
+}
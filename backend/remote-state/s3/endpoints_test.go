@@ -0,0 +1,88 @@
+package s3
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/backend"
+)
+
+func TestEndpointPartition(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint  string
+		partition string
+		ok        bool
+	}{
+		{"s3.amazonaws.com", "aws", true},
+		{"https://s3.us-west-2.amazonaws.com", "aws", true},
+		{"https://s3-fips.us-gov-west-1.amazonaws.com", "aws-us-gov", true},
+		{"https://s3.cn-north-1.amazonaws.com.cn", "aws-cn", true},
+		{"http://localhost:9000", "", false},
+		{"https://storage.example.com", "", false},
+	} {
+		partition, ok := endpointPartition(tc.endpoint)
+		if partition != tc.partition || ok != tc.ok {
+			t.Fatalf("%s: expected %q, %t, got %q, %t", tc.endpoint, tc.partition, tc.ok, partition, ok)
+		}
+	}
+}
+
+func TestBackendConfig_govCloud(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-gov-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"lock_table":             "tf-lock",
+		"skip_lock_table_check":  true,
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if e := b.client.nativeClient.Endpoint; e != "https://s3-us-gov-west-1.amazonaws.com" {
+		t.Fatalf("bad S3 endpoint: %s", e)
+	}
+	if e := b.client.dynClient.Endpoint; e != "https://dynamodb.us-gov-west-1.amazonaws.com" {
+		t.Fatalf("bad DynamoDB endpoint: %s", e)
+	}
+	if r := b.client.nativeClient.SigningRegion; r != "us-gov-west-1" {
+		t.Fatalf("bad signing region: %s", r)
+	}
+
+	config["use_fips_endpoint"] = true
+	b = backend.TestBackendConfig(t, New(), config).(*Backend)
+	if e := b.client.nativeClient.Endpoint; e != "https://s3-fips.us-gov-west-1.amazonaws.com" {
+		t.Fatalf("bad S3 FIPS endpoint: %s", e)
+	}
+}
+
+func TestBackendConfig_endpointPartitionMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	config := map[string]interface{}{
+		"region":                 "us-gov-west-1",
+		"bucket":                 "tf-test",
+		"key":                    "state",
+		"endpoint":               "https://s3.us-east-1.amazonaws.com",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+	backend.TestBackendConfig(t, New(), config)
+	if !strings.Contains(buf.String(), "[WARN] The endpoint") {
+		t.Fatalf("expected a warning about the endpoint's partition, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	config["endpoint"] = "https://s3-fips.us-gov-west-1.amazonaws.com"
+	backend.TestBackendConfig(t, New(), config)
+	if strings.Contains(buf.String(), "[WARN] The endpoint") {
+		t.Fatalf("expected no warning, got:\n%s", buf.String())
+	}
+}
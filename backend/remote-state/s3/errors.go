@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Errors for common failures, which the errors returned by S3Client wrap in
+// an *Error of that Kind. With Go 1.13 and later, they can also be checked
+// with errors.Is, and the underlying AWS error found with errors.As.
+var (
+	// ErrStateNotFound means the state object doesn't exist. Get returns
+	// nil state instead.
+	ErrStateNotFound = errors.New("state not found")
+
+	// ErrAccessDenied means the credentials aren't allowed to access the
+	// bucket, the state or the lock table.
+	ErrAccessDenied = errors.New("access denied")
+
+	// ErrBucketRegionMismatch means the bucket isn't in the configured
+	// region.
+	ErrBucketRegionMismatch = errors.New("bucket is in another region")
+
+	// ErrLockTableMissing means the lock table doesn't exist.
+	ErrLockTableMissing = errors.New("lock table does not exist")
+
+	// ErrStateConflict means state wasn't written with optimistic_locking,
+	// because it was changed since it was read.
+	ErrStateConflict = errors.New("state was changed since it was read")
+)
+
+// Error is an error of one of the kinds above.
+type Error struct {
+	// Kind is one of the Err variables.
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classify wraps err in an Error of the kind its AWS error code means,
+// returning err unchanged if it isn't one of them.
+func classify(err error) error {
+	awsErr, ok := awsError(err)
+	if !ok {
+		return err
+	}
+
+	var kind error
+	switch awsErr.Code() {
+	case s3.ErrCodeNoSuchKey:
+		kind = ErrStateNotFound
+	case "AccessDenied", "AccessDeniedException":
+		kind = ErrAccessDenied
+	case "PermanentRedirect", "AuthorizationHeaderMalformed":
+		kind = ErrBucketRegionMismatch
+	case dynamodb.ErrCodeResourceNotFoundException:
+		kind = ErrLockTableMissing
+	default:
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// classifyAction is classify for a failed request of the IAM action on
+// resource. When access is denied, the error names the action, since the
+// AWS error doesn't say which permission is missing.
+func classifyAction(err error, action, resource string) error {
+	err = classify(err)
+	if e, ok := err.(*Error); ok && e.Kind == ErrAccessDenied {
+		e.Err = wrapf(e.Err, "Access denied, missing %s on %s: %s", action, resource, e.Err)
+	}
+	return err
+}
+
+// wrappedError is an error with a message of its own that wraps err, like
+// the errors fmt.Errorf returns for %w, which needs Go 1.13.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return e.msg
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// wrapf returns an error with the formatted message that wraps err. The
+// arguments usually include err, for its message.
+func wrapf(err error, format string, args ...interface{}) error {
+	return &wrappedError{msg: fmt.Sprintf(format, args...), err: err}
+}
+
+// unwrap returns the error that err wraps, or nil. Errors of the standard
+// library that predate Unwrap are looked through as well.
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case interface {
+		Unwrap() error
+	}:
+		return e.Unwrap()
+	case *url.Error:
+		return e.Err
+	case *net.OpError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	}
+	return nil
+}
+
+// isError reports whether err, or an error it wraps, is target. It's
+// errors.Is, which needs Go 1.13.
+func isError(err, target error) bool {
+	for ; err != nil; err = unwrap(err) {
+		if err == target {
+			return true
+		}
+		if e, ok := err.(interface {
+			Is(error) bool
+		}); ok && e.Is(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// awsError returns the first AWS error that err is or wraps, like
+// errors.As.
+func awsError(err error) (awserr.Error, bool) {
+	for ; err != nil; err = unwrap(err) {
+		if awsErr, ok := err.(awserr.Error); ok {
+			return awsErr, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,176 @@
+package s3
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/hashicorp/terraform/state"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		want error
+	}{
+		{"NoSuchKey", ErrStateNotFound},
+		{"AccessDenied", ErrAccessDenied},
+		{"AccessDeniedException", ErrAccessDenied},
+		{"PermanentRedirect", ErrBucketRegionMismatch},
+		{"AuthorizationHeaderMalformed", ErrBucketRegionMismatch},
+		{"ResourceNotFoundException", ErrLockTableMissing},
+	} {
+		awsErr := awserr.NewRequestFailure(awserr.New(tc.code, "test", nil), 400, "request-id")
+		err := classify(awsErr)
+		if !isError(err, tc.want) {
+			t.Fatalf("%s: expected %q, got %#v", tc.code, tc.want, err)
+		}
+		if err.Error() != awsErr.Error() {
+			t.Fatalf("%s: message changed to %q", tc.code, err)
+		}
+		if e, ok := awsError(err); !ok || e.Code() != tc.code {
+			t.Fatalf("%s: AWS error isn't available, got %#v", tc.code, err)
+		}
+	}
+
+	err := awserr.New("InternalError", "test", nil)
+	if got := classify(err); got != err {
+		t.Fatalf("expected an unknown error unchanged, got %#v", got)
+	}
+	if classify(nil) != nil {
+		t.Fatal("expected nil")
+	}
+}
+
+func TestIsError(t *testing.T) {
+	awsErr := awserr.New("AccessDenied", "test", nil)
+	for _, tc := range []struct {
+		err, target error
+		want        bool
+	}{
+		{nil, ErrAccessDenied, false},
+		{ErrAccessDenied, ErrAccessDenied, true},
+		{classify(awsErr), ErrAccessDenied, true},
+		{classify(awsErr), ErrStateNotFound, false},
+		{wrapf(classify(awsErr), "outer: %s", awsErr), ErrAccessDenied, true},
+		{wrapf(context.Canceled, "outer: %s", context.Canceled), context.Canceled, true},
+		// Errors of the standard library that predate Unwrap.
+		{&url.Error{Op: "Get", URL: "https://s3.amazonaws.com", Err: context.Canceled}, context.Canceled, true},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, syscall.ECONNRESET, true},
+	} {
+		if got := isError(tc.err, tc.target); got != tc.want {
+			t.Fatalf("isError(%v, %v): expected %t, got %t", tc.err, tc.target, tc.want, got)
+		}
+	}
+
+	if e, ok := awsError(wrapf(classify(awsErr), "outer: %s", awsErr)); !ok || e != awsErr {
+		t.Fatalf("expected the wrapped AWS error, got %v", e)
+	}
+}
+
+func TestRemoteClientErrors(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+
+	stub.handlers["GetObject"] = func(r *request.Request) {
+		stubError(r, 403, "AccessDenied")
+	}
+	if _, err := c.Get(); !isError(err, ErrAccessDenied) {
+		t.Fatalf("get: expected ErrAccessDenied, got %#v", err)
+	}
+
+	stub.handlers["PutObject"] = func(r *request.Request) {
+		stubError(r, 301, "PermanentRedirect")
+	}
+	if err := c.Put([]byte("test state")); !isError(err, ErrBucketRegionMismatch) {
+		t.Fatalf("put: expected ErrBucketRegionMismatch, got %#v", err)
+	}
+
+	stub.handlers["PutItem"] = func(r *request.Request) {
+		stubError(r, 400, "ResourceNotFoundException")
+	}
+	info := state.NewLockInfo()
+	info.Operation = "test"
+	_, err := c.Lock(info)
+	if !isError(err, ErrLockTableMissing) {
+		t.Fatalf("lock: expected ErrLockTableMissing, got %#v", err)
+	}
+	if _, ok := err.(*state.LockError); !ok {
+		t.Fatalf("lock: expected a LockError, got %#v", err)
+	}
+
+	stub.handlers["CopyObject"] = func(r *request.Request) {
+		stubError(r, 404, "NoSuchKey")
+	}
+	if err := c.Move("renamed", false); !isError(err, ErrStateNotFound) {
+		t.Fatalf("move: expected ErrStateNotFound, got %#v", err)
+	}
+}
+
+func TestRemoteClientAccessDenied(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	for _, op := range []string{"GetObject", "PutObject", "PutItem"} {
+		stub.handlers[op] = func(r *request.Request) {
+			stubError(r, 403, "AccessDenied")
+		}
+	}
+
+	_, getErr := c.Get()
+	putErr := c.Put([]byte("test state"))
+	_, lockErr := c.Lock(state.NewLockInfo())
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"get", getErr, `missing s3:GetObject on tf-test/state`},
+		{"put", putErr, `missing s3:PutObject on tf-test/state`},
+		{"lock", lockErr, `missing dynamodb:PutItem on DynamoDB table "tf-lock"`},
+	} {
+		if !isError(tc.err, ErrAccessDenied) {
+			t.Fatalf("%s: expected ErrAccessDenied, got %#v", tc.name, tc.err)
+		}
+		if !strings.Contains(tc.err.Error(), tc.want) {
+			t.Fatalf("%s: expected the error to contain %q, got %q", tc.name, tc.want, tc.err)
+		}
+		if e, ok := awsError(tc.err); !ok || e.Code() != "AccessDenied" {
+			t.Fatalf("%s: AWS error isn't available, got %#v", tc.name, tc.err)
+		}
+	}
+}
+
+func TestRemoteClientPutEncryptionRequired(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+
+	// A bucket policy denying unencrypted writes.
+	stub.handlers["PutObject"] = func(r *request.Request) {
+		if r.Params.(*s3.PutObjectInput).ServerSideEncryption == nil {
+			stubError(r, 403, "AccessDenied")
+			return
+		}
+		stub.serve(r)
+	}
+
+	err := c.Put([]byte("test state"))
+	if !isError(err, ErrAccessDenied) {
+		t.Fatalf("expected ErrAccessDenied, got %#v", err)
+	}
+	if !strings.Contains(err.Error(), "set encrypt to true") {
+		t.Fatalf("expected the error to recommend encrypt, got %q", err)
+	}
+
+	c.serverSideEncryption = true
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+package s3
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3 Express One Zone directory buckets are named
+// base-name--zone-id--x-s3, and are served by an endpoint in their
+// availability zone, which authenticates requests with session credentials
+// from CreateSession. The vendored SDK predates them, so the routing,
+// sessions and CreateSession operation are implemented here.
+
+const directoryBucketSuffix = "--x-s3"
+
+// parseDirectoryBucket returns the zone ID of a directory bucket, such as
+// usw2-az1, or false if bucket isn't one.
+func parseDirectoryBucket(bucket string) (string, bool) {
+	if !strings.HasSuffix(bucket, directoryBucketSuffix) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimSuffix(bucket, directoryBucketSuffix), "--")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// directoryBucketHost returns the host of the zonal endpoint of a directory
+// bucket.
+func directoryBucketHost(bucket, zone, region string) string {
+	return fmt.Sprintf("%s.s3express-%s.%s.%s", bucket, zone, region, dnsSuffix(region))
+}
+
+// routeToDirectoryBucket returns a Build handler that sends requests for the
+// directory bucket to its zonal endpoint. The client must use path style
+// addressing, so that the bucket is at the start of the path.
+func routeToDirectoryBucket(bucket, zone string) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "terraform.s3.RouteToDirectoryBucketHandler",
+		Fn: func(r *request.Request) {
+			u := r.HTTPRequest.URL
+			prefix := "/" + bucket
+			if u.Path != prefix && !strings.HasPrefix(u.Path, prefix+"/") {
+				return
+			}
+
+			region := aws.StringValue(r.Config.Region)
+			u.Host = directoryBucketHost(bucket, zone, region)
+			u.Path = strings.TrimPrefix(u.Path, prefix)
+			u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+			if u.Path == "" {
+				u.Path = "/"
+				u.RawPath = ""
+			}
+
+			r.ClientInfo.SigningName = "s3express"
+			r.ClientInfo.SigningRegion = region
+		},
+	}
+}
+
+const opCreateSession = "CreateSession"
+
+type createSessionInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+}
+
+type createSessionOutput struct {
+	_ struct{} `type:"structure"`
+
+	Credentials *sessionCredentials `locationName:"Credentials" type:"structure"`
+}
+
+type sessionCredentials struct {
+	_ struct{} `type:"structure"`
+
+	AccessKeyId     *string    `type:"string"`
+	Expiration      *time.Time `type:"timestamp" timestampFormat:"iso8601"`
+	SecretAccessKey *string    `type:"string"`
+	SessionToken    *string    `type:"string"`
+}
+
+// sessionRefreshWindow is how long before they expire session credentials
+// are replaced.
+const sessionRefreshWindow = time.Minute
+
+// expressSession signs the requests for a directory bucket with session
+// credentials, creating a new session when they are about to expire.
+type expressSession struct {
+	client *s3.S3
+	bucket string
+
+	mu    sync.Mutex
+	creds *sessionCredentials
+}
+
+// signHandler returns a Sign handler, to run before the SDK's signer, that
+// makes it sign with the session credentials. CreateSession itself is
+// signed with the client's credentials.
+func (s *expressSession) signHandler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "terraform.s3.ExpressSessionHandler",
+		Fn: func(r *request.Request) {
+			if r.Operation.Name == opCreateSession {
+				return
+			}
+
+			creds, err := s.credentials()
+			if err != nil {
+				r.Error = fmt.Errorf("Error creating a session for S3 directory bucket %q: %s", s.bucket, err)
+				return
+			}
+			r.Config.Credentials = credentials.NewStaticCredentials(
+				aws.StringValue(creds.AccessKeyId), aws.StringValue(creds.SecretAccessKey), "")
+			r.HTTPRequest.Header.Set("X-Amz-S3session-Token", aws.StringValue(creds.SessionToken))
+		},
+	}
+}
+
+// credentials returns the current session credentials, creating a session
+// if there is none or it is about to expire.
+func (s *expressSession) credentials() (*sessionCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.creds != nil && time.Now().Add(sessionRefreshWindow).Before(aws.TimeValue(s.creds.Expiration)) {
+		return s.creds, nil
+	}
+
+	output := &createSessionOutput{}
+	req := s.client.NewRequest(&request.Operation{
+		Name:       opCreateSession,
+		HTTPMethod: "GET",
+		HTTPPath:   "/{Bucket}?session",
+	}, &createSessionInput{Bucket: aws.String(s.bucket)}, output)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	if output.Credentials == nil {
+		return nil, fmt.Errorf("CreateSession returned no credentials")
+	}
+
+	s.creds = output.Credentials
+	return s.creds, nil
+}
+
+// directoryBucketUnsupported are the options that can't be used with a
+// directory bucket. Directory buckets don't support versioning, object
+// lock or requester pays, and are only served by their zonal endpoint.
+var directoryBucketUnsupported = []string{
+	"purge_versions",
+	"object_lock_mode",
+	"request_payer",
+	"endpoint",
+	"accelerate",
+	"use_dualstack_endpoint",
+	"use_fips_endpoint",
+	"bootstrap_bucket",
+	"manage_bucket_logging",
+	"require_versioning",
+}
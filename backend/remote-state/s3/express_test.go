@@ -0,0 +1,123 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/hashicorp/terraform/backend"
+)
+
+func TestParseDirectoryBucket(t *testing.T) {
+	for _, tc := range []struct {
+		bucket string
+		zone   string
+		ok     bool
+	}{
+		{"state--usw2-az1--x-s3", "usw2-az1", true},
+		{"my-state--use1-az4--x-s3", "use1-az4", true},
+		{"state", "", false},
+		{"state--x-s3", "", false},
+		{"a--b--usw2-az1--x-s3", "", false},
+	} {
+		zone, ok := parseDirectoryBucket(tc.bucket)
+		if zone != tc.zone || ok != tc.ok {
+			t.Fatalf("%s: expected %q, %t, got %q, %t", tc.bucket, tc.zone, tc.ok, zone, ok)
+		}
+	}
+}
+
+func TestBackendDirectoryBucket(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-2",
+		"bucket":                 "tf-test--usw2-az1--x-s3",
+		"key":                    "path/state",
+		"skip_bucket_validation": true,
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+	}
+
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+	stub.handlers["CreateSession"] = func(r *request.Request) {
+		r.Data.(*createSessionOutput).Credentials = &sessionCredentials{
+			AccessKeyId:     aws.String("SESSION_KEY"),
+			SecretAccessKey: aws.String("SESSION_SECRET"),
+			SessionToken:    aws.String("SESSION_TOKEN"),
+			Expiration:      aws.Time(time.Now().Add(5 * time.Minute)),
+		}
+	}
+
+	if err := b.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := b.client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != "test state" {
+		t.Fatalf("bad state: %q", p.Data)
+	}
+	if err := b.client.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	host := "tf-test--usw2-az1--x-s3.s3express-usw2-az1.us-west-2.amazonaws.com"
+
+	sessions := stub.requests("CreateSession")
+	if len(sessions) != 1 {
+		t.Fatalf("expected one session to be created, got %d", len(sessions))
+	}
+	u := sessions[0].HTTPRequest.URL
+	if u.Host != host || u.Path != "/" || u.Query()["session"] == nil {
+		t.Fatalf("bad CreateSession URL: %s", u)
+	}
+	if auth := sessions[0].HTTPRequest.Header.Get("Authorization"); !strings.Contains(auth, "Credential=ACCESS_KEY/") ||
+		!strings.Contains(auth, "/us-west-2/s3express/aws4_request") {
+		t.Fatalf("CreateSession isn't signed with the configured credentials for s3express: %s", auth)
+	}
+
+	for _, op := range []string{"PutObject", "GetObject", "DeleteObject"} {
+		r := stub.requests(op)[0].HTTPRequest
+		if r.URL.Host != host || r.URL.Path != "/path/state" {
+			t.Fatalf("%s: bad URL: %s", op, r.URL)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "Credential=SESSION_KEY/") ||
+			!strings.Contains(auth, "/us-west-2/s3express/aws4_request") {
+			t.Fatalf("%s: not signed with the session credentials: %s", op, auth)
+		}
+		if got := r.Header.Get("X-Amz-S3session-Token"); got != "SESSION_TOKEN" {
+			t.Fatalf("%s: expected the session token, got %q", op, got)
+		}
+		if got := r.Header.Get("X-Amz-Security-Token"); got != "" {
+			t.Fatalf("%s: unexpected security token %q", op, got)
+		}
+	}
+}
+
+func TestBackendDirectoryBucketUnsupported(t *testing.T) {
+	for option, value := range map[string]interface{}{
+		"acl":            "private",
+		"purge_versions": true,
+		"endpoint":       "http://localhost:9000",
+		"request_payer":  "requester",
+	} {
+		config := map[string]interface{}{
+			"region":                 "us-west-2",
+			"bucket":                 "tf-test--usw2-az1--x-s3",
+			"key":                    "state",
+			"skip_bucket_validation": true,
+			"access_key":             "ACCESS_KEY",
+			"secret_key":             "SECRET_KEY",
+		}
+		config[option] = value
+
+		err := testBackendConfigErr(t, config)
+		if err == nil || !strings.Contains(err.Error(), option+" can't be used with the S3 Express One Zone directory bucket") {
+			t.Fatalf("%s: expected an error about the directory bucket, got %v", option, err)
+		}
+	}
+}
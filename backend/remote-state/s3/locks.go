@@ -0,0 +1,95 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/hashicorp/terraform/state"
+)
+
+// LockEntry is a lock found in the lock table.
+type LockEntry struct {
+	// LockID is the key of the lock in the table, usually the path of the
+	// locked state.
+	LockID string
+
+	// Info describes who holds the lock. It's nil if the stored info can't
+	// be parsed.
+	Info *state.LockInfo
+
+	// Expires is when the lock expires, for locks taken with lock_ttl.
+	Expires time.Time
+}
+
+// ListLocks returns every lock in the lock table, across all states, sorted
+// by lock ID, so stale locks can be found. Other items in the table, such as
+// stored state checksums, are skipped.
+func (c *S3Client) ListLocks(ctx context.Context) ([]*LockEntry, error) {
+	if c.lockTable == "" {
+		return nil, nil
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(c.lockTable),
+		ConsistentRead: aws.Bool(true),
+	}
+
+	var locks []*LockEntry
+	for {
+		var page *dynamodb.ScanOutput
+		err := c.retry(ctx, func() error {
+			var req *request.Request
+			req, page = c.dynClient.ScanRequest(input)
+			return sendOnce(ctx, req)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error listing locks in DynamoDB table %q: %s", c.lockTable, classify(err))
+		}
+
+		for _, item := range page.Items {
+			if lock := c.lockEntry(item); lock != nil {
+				locks = append(locks, lock)
+			}
+		}
+
+		if len(page.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = page.LastEvaluatedKey
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].LockID < locks[j].LockID
+	})
+	return locks, nil
+}
+
+// lockEntry returns the lock stored in item, or nil if it isn't a lock.
+func (c *S3Client) lockEntry(item map[string]*dynamodb.AttributeValue) *LockEntry {
+	key, ok := item[c.lockKeyName]
+	if !ok || key.S == nil || item["Info"] == nil {
+		return nil
+	}
+
+	lock := &LockEntry{LockID: *key.S}
+	info, err := lockInfoFromItem(item)
+	if err != nil {
+		log.Printf("[WARN] Unable to parse the info of lock %q: %s", lock.LockID, err)
+	} else {
+		lock.Info = info
+	}
+
+	if v, ok := item["Expires"]; ok && v.N != nil {
+		if sec, err := strconv.ParseInt(*v.N, 10, 64); err == nil {
+			lock.Expires = time.Unix(sec, 0)
+		}
+	}
+	return lock
+}
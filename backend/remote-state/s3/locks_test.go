@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/hashicorp/terraform/state"
+)
+
+func TestRemoteClientListLocks(t *testing.T) {
+	stub := newStubAWS()
+
+	// Five locks span three scan pages of two items.
+	keys := []string{"env:/prod/state", "state", "env:/dev/state", "env:/test/state", "other"}
+	ids := make(map[string]string)
+	for _, key := range keys {
+		c := stub.client()
+		c.keyName = key
+		c.lockTTL = time.Hour
+
+		info := state.NewLockInfo()
+		info.Operation = "apply"
+		id, err := c.Lock(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids["tf-test/"+key] = id
+	}
+
+	// Items that aren't locks are skipped.
+	stub.items["tf-test/state-sha256"] = map[string]*dynamodb.AttributeValue{
+		"LockID": {S: aws.String("tf-test/state-sha256")},
+		"Digest": {S: aws.String("sum")},
+	}
+	// A lock with info that can't be parsed is still listed.
+	stub.items["tf-test/broken"] = map[string]*dynamodb.AttributeValue{
+		"LockID": {S: aws.String("tf-test/broken")},
+		"Info":   {S: aws.String("{")},
+	}
+
+	c := stub.client()
+	locks, err := c.ListLocks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(stub.requests("Scan")); n != 4 {
+		t.Fatalf("expected the table to be scanned in 4 pages, got %d", n)
+	}
+
+	want := []string{
+		"tf-test/broken",
+		"tf-test/env:/dev/state",
+		"tf-test/env:/prod/state",
+		"tf-test/env:/test/state",
+		"tf-test/other",
+		"tf-test/state",
+	}
+	if len(locks) != len(want) {
+		t.Fatalf("expected %d locks, got %d", len(want), len(locks))
+	}
+	for i, lock := range locks {
+		if lock.LockID != want[i] {
+			t.Fatalf("expected lock %q, got %q", want[i], lock.LockID)
+		}
+		if lock.LockID == "tf-test/broken" {
+			if lock.Info != nil || !lock.Expires.IsZero() {
+				t.Fatalf("expected no info or expiry for the broken lock, got %#v", lock)
+			}
+			continue
+		}
+
+		if lock.Info == nil || lock.Info.ID != ids[lock.LockID] || lock.Info.Operation != "apply" {
+			t.Fatalf("%s: bad lock info: %#v", lock.LockID, lock.Info)
+		}
+		if lock.Info.Path != lock.LockID {
+			t.Fatalf("%s: bad lock path %q", lock.LockID, lock.Info.Path)
+		}
+		if d := time.Until(lock.Expires); d <= 0 || d > time.Hour {
+			t.Fatalf("%s: bad expiry %s", lock.LockID, lock.Expires)
+		}
+	}
+
+	// Without a lock table there are no locks.
+	c.lockTable = ""
+	if locks, err := c.ListLocks(context.Background()); err != nil || locks != nil {
+		t.Fatalf("expected no locks without a lock table, got %v, %v", locks, err)
+	}
+}
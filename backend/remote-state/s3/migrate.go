@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/state"
+)
+
+// MigrateOptions control how MigrateTo copies state.
+type MigrateOptions struct {
+	// Force overwrites state that already exists at the destination.
+	Force bool
+
+	// Verify reads the state back from the destination after writing it,
+	// and checks it's the state that was read from the source.
+	Verify bool
+}
+
+// MigrateTo copies the state of the backend to the dest backend, such as a
+// backend for another bucket when buckets are reorganized. Both states are
+// locked while the state is copied, so it can't change in the meantime. The
+// source state is left in place.
+func (b *Backend) MigrateTo(dest *Backend, opts MigrateOptions) (err error) {
+	src, dst := b.client, dest.client
+	if src.StatePath() == dst.StatePath() && src.nativeClient.Endpoint == dst.nativeClient.Endpoint {
+		return fmt.Errorf("Can't migrate state %s to itself", src.StatePath())
+	}
+
+	info := state.NewLockInfo()
+	info.Operation = "migrate"
+	info.Info = fmt.Sprintf("Migrating state from %s to %s", src.StatePath(), dst.StatePath())
+
+	for _, c := range []*S3Client{src, dst} {
+		id, lockErr := c.Lock(info)
+		if lockErr != nil {
+			return lockErr
+		}
+		defer func(c *S3Client) {
+			if unlockErr := c.Unlock(id); unlockErr != nil {
+				err = multierror.Append(err, unlockErr)
+			}
+		}(c)
+	}
+
+	payload, err := src.Get()
+	if err != nil {
+		return fmt.Errorf("Error reading state to migrate from %s: %s", src.StatePath(), err)
+	}
+	if payload == nil {
+		return fmt.Errorf("There is no state to migrate at %s", src.StatePath())
+	}
+
+	if !opts.Force {
+		exists, err := dst.Exists()
+		if err != nil {
+			return fmt.Errorf("Error checking for state at %s: %s", dst.StatePath(), err)
+		}
+		if exists {
+			return fmt.Errorf("Can't migrate state to %s, state already exists there", dst.StatePath())
+		}
+	}
+
+	if err := dst.Put(payload.Data); err != nil {
+		return fmt.Errorf("Error writing migrated state to %s: %s", dst.StatePath(), err)
+	}
+
+	if opts.Verify {
+		copied, err := dst.Get()
+		if err != nil {
+			return fmt.Errorf("Error reading migrated state back from %s: %s", dst.StatePath(), err)
+		}
+		if copied == nil || !bytes.Equal(copied.Data, payload.Data) {
+			return fmt.Errorf("Migrated state at %s doesn't match the state at %s", dst.StatePath(), src.StatePath())
+		}
+	}
+
+	log.Printf("[INFO] Migrated state %s to %s", src.StatePath(), dst.StatePath())
+	return nil
+}
@@ -0,0 +1,89 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestBackendMigrateTo(t *testing.T) {
+	srcStub, dstStub := newStubAWS(), newStubAWS()
+	src := &Backend{client: srcStub.client()}
+	dst := &Backend{client: dstStub.client()}
+	dst.client.bucketName = "tf-test-new"
+	dst.client.keyName = "team/state"
+	dst.client.compress = true
+
+	// There's nothing to migrate yet.
+	if err := src.MigrateTo(dst, MigrateOptions{}); err == nil || !strings.Contains(err.Error(), "no state to migrate") {
+		t.Fatalf("expected an error about missing state, got %v", err)
+	}
+
+	if err := src.client.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	srcStub.calls, dstStub.calls = nil, nil
+	if err := src.MigrateTo(dst, MigrateOptions{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := dst.client.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || string(p.Data) != "test state" {
+		t.Fatalf("bad migrated state: %v", p)
+	}
+	if _, ok := srcStub.objects["state"]; !ok {
+		t.Fatal("source state was removed")
+	}
+
+	// Both states were locked during the copy, and are unlocked again.
+	for name, stub := range map[string]*stubAWS{"source": srcStub, "destination": dstStub} {
+		var n int
+		for _, r := range stub.requests("PutItem") {
+			if _, ok := r.Params.(*dynamodb.PutItemInput).Item["Info"]; ok {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("expected the %s state to be locked, got %d locks", name, n)
+		}
+		if locks := stub.locks(); len(locks) != 0 {
+			t.Fatalf("%s lock wasn't released: %v", name, locks)
+		}
+	}
+
+	// Existing state isn't overwritten unless forced.
+	if err := src.client.Put([]byte("new state")); err != nil {
+		t.Fatal(err)
+	}
+	err = src.MigrateTo(dst, MigrateOptions{})
+	if err == nil || !strings.Contains(err.Error(), "state already exists") {
+		t.Fatalf("expected an error about existing state, got %v", err)
+	}
+	if err := src.MigrateTo(dst, MigrateOptions{Force: true}); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := dst.client.Get(); err != nil || string(p.Data) != "new state" {
+		t.Fatalf("state wasn't overwritten: %v, %v", p, err)
+	}
+
+	// Verification catches a copy that doesn't match.
+	dstStub.handlers["PutObject"] = func(r *request.Request) {
+		dstStub.serve(r)
+		dstStub.objects["team/state"] = []byte("damaged")
+	}
+	dst.client.compress = false
+	err = src.MigrateTo(dst, MigrateOptions{Force: true, Verify: true})
+	if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+
+	// A backend can't be migrated to itself.
+	if err := src.MigrateTo(src, MigrateOptions{Force: true}); err == nil {
+		t.Fatal("expected an error migrating state to itself")
+	}
+}
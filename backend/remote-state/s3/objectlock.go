@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// The vendored SDK predates S3 Object Lock, so the GetObjectLegalHold and
+// GetObjectRetention operations are defined here, with only the fields that
+// are used.
+
+const (
+	opGetObjectLegalHold = "GetObjectLegalHold"
+	opGetObjectRetention = "GetObjectRetention"
+)
+
+type getObjectLockInput struct {
+	_ struct{} `type:"structure"`
+
+	Bucket       *string `location:"uri" locationName:"Bucket" type:"string" required:"true"`
+	Key          *string `location:"uri" locationName:"Key" min:"1" type:"string" required:"true"`
+	RequestPayer *string `location:"header" locationName:"x-amz-request-payer" type:"string"`
+}
+
+type getObjectLegalHoldOutput struct {
+	_ struct{} `type:"structure" payload:"LegalHold"`
+
+	LegalHold *objectLockLegalHold `type:"structure"`
+}
+
+type objectLockLegalHold struct {
+	_ struct{} `type:"structure"`
+
+	Status *string `type:"string"`
+}
+
+type getObjectRetentionOutput struct {
+	_ struct{} `type:"structure" payload:"Retention"`
+
+	Retention *objectLockRetention `type:"structure"`
+}
+
+type objectLockRetention struct {
+	_ struct{} `type:"structure"`
+
+	Mode            *string    `type:"string"`
+	RetainUntilDate *time.Time `type:"timestamp" timestampFormat:"iso8601"`
+}
+
+// errCodeNoObjectLockConfiguration is returned by GetObjectLegalHold and
+// GetObjectRetention for objects without a legal hold or retention.
+const errCodeNoObjectLockConfiguration = "NoSuchObjectLockConfiguration"
+
+// ObjectLockStatus is the S3 Object Lock status of the state object.
+type ObjectLockStatus struct {
+	// LegalHold is true if the object is under a legal hold.
+	LegalHold bool
+
+	// Mode is the retention mode of the object, GOVERNANCE or COMPLIANCE,
+	// or empty if it has no retention.
+	Mode string
+
+	// RetainUntil is when the retention of the object ends.
+	RetainUntil time.Time
+}
+
+// ObjectLockStatus returns the legal hold and retention of the current
+// version of the state object, for auditing. It needs the
+// s3:GetObjectLegalHold and s3:GetObjectRetention permissions, and the bucket
+// must have Object Lock enabled.
+func (c *S3Client) ObjectLockStatus(ctx context.Context) (*ObjectLockStatus, error) {
+	status := &ObjectLockStatus{}
+
+	legalHold := &getObjectLegalHoldOutput{}
+	err := c.getObjectLock(ctx, opGetObjectLegalHold, "?legal-hold", legalHold)
+	if err != nil {
+		return nil, classifyAction(err, "s3:GetObjectLegalHold", c.StatePath())
+	}
+	if legalHold.LegalHold != nil {
+		status.LegalHold = aws.StringValue(legalHold.LegalHold.Status) == "ON"
+	}
+
+	retention := &getObjectRetentionOutput{}
+	err = c.getObjectLock(ctx, opGetObjectRetention, "?retention", retention)
+	if err != nil {
+		return nil, classifyAction(err, "s3:GetObjectRetention", c.StatePath())
+	}
+	if retention.Retention != nil {
+		status.Mode = aws.StringValue(retention.Retention.Mode)
+		status.RetainUntil = aws.TimeValue(retention.Retention.RetainUntilDate)
+	}
+
+	return status, nil
+}
+
+// getObjectLock sends one of the object lock operations defined above for
+// the state object. An object without the legal hold or retention asked for
+// leaves output empty.
+func (c *S3Client) getObjectLock(ctx context.Context, name, query string, output interface{}) error {
+	input := &getObjectLockInput{
+		Bucket:       &c.bucketName,
+		Key:          &c.keyName,
+		RequestPayer: c.requestPayerValue(),
+	}
+	err := c.retry(ctx, func() error {
+		req := c.nativeClient.NewRequest(&request.Operation{
+			Name:       name,
+			HTTPMethod: "GET",
+			HTTPPath:   "/{Bucket}/{Key+}" + query,
+		}, input, output)
+		return sendOnce(ctx, req)
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == errCodeNoObjectLockConfiguration {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package s3
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/restxml"
+)
+
+// stubXML returns a handler that answers with body, unmarshalled like S3's
+// responses are, so the operations defined without the SDK are checked too.
+func stubXML(body string) func(*request.Request) {
+	return func(r *request.Request) {
+		r.HTTPResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+		restxml.Unmarshal(r)
+	}
+}
+
+func TestRemoteClientObjectLockStatus(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+
+	stub.handlers[opGetObjectLegalHold] = stubXML(`<LegalHold><Status>ON</Status></LegalHold>`)
+	stub.handlers[opGetObjectRetention] = stubXML(`<Retention><Mode>COMPLIANCE</Mode>` +
+		`<RetainUntilDate>2030-01-02T03:04:05.000Z</RetainUntilDate></Retention>`)
+
+	status, err := c.ObjectLockStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !status.LegalHold || status.Mode != "COMPLIANCE" || !status.RetainUntil.Equal(want) {
+		t.Fatalf("unexpected object lock status: %#v", status)
+	}
+
+	r := stub.requests(opGetObjectLegalHold)[0]
+	if _, ok := r.HTTPRequest.URL.Query()["legal-hold"]; !ok || r.HTTPRequest.URL.Path != "/state" {
+		t.Fatalf("unexpected legal hold request: %s", r.HTTPRequest.URL)
+	}
+
+	// Objects without a legal hold or retention have neither.
+	stub.handlers[opGetObjectLegalHold] = stubXML(`<LegalHold><Status>OFF</Status></LegalHold>`)
+	stub.handlers[opGetObjectRetention] = func(r *request.Request) {
+		stubError(r, http.StatusNotFound, errCodeNoObjectLockConfiguration)
+	}
+	status, err = c.ObjectLockStatus(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LegalHold || status.Mode != "" || !status.RetainUntil.IsZero() {
+		t.Fatalf("expected no legal hold or retention, got %#v", status)
+	}
+
+	// A missing permission is named.
+	stub.handlers[opGetObjectRetention] = func(r *request.Request) {
+		stubError(r, http.StatusForbidden, "AccessDenied")
+	}
+	_, err = c.ObjectLockStatus(context.Background())
+	if !isError(err, ErrAccessDenied) || !strings.Contains(err.Error(), "s3:GetObjectRetention") {
+		t.Fatalf("expected access denied naming s3:GetObjectRetention, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/hashicorp/terraform/state"
+)
+
+const (
+	// Bounds for the delay between retries of a throttled request.
+	retryMinDelay = 100 * time.Millisecond
+	retryMaxDelay = 20 * time.Second
+)
+
+// throttleCodes are the error codes of throttled requests: SlowDown from S3,
+// RequestLimitExceeded and ThrottlingException from STS and other AWS APIs,
+// and ProvisionedThroughputExceededException from DynamoDB.
+var throttleCodes = map[string]bool{
+	"SlowDown":                               true,
+	"RequestLimitExceeded":                   true,
+	"ThrottlingException":                    true,
+	"ProvisionedThroughputExceededException": true,
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't
+// transient, has been retried maxRetries times, or ctx is done. Expired
+// credentials are refreshed, and fn is called once more, regardless of
+// maxRetries, since temporary credentials can expire during a long run.
+// The requests fn makes must be sent with sendOnce, so that failures are
+// only retried here and not by the SDK as well. Errors are returned
+// unchanged.
+func (c *S3Client) retry(ctx context.Context, fn func() error) error {
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !refreshed && isExpiredToken(err) {
+			log.Printf("[DEBUG] AWS credentials expired, refreshing them: %s", err)
+			c.expireCredentials()
+			refreshed = true
+			err = fn()
+		}
+		if err == nil || !isTransient(err) || attempt >= c.maxRetries {
+			return err
+		}
+
+		delay := retryDelay(attempt)
+		log.Printf("[DEBUG] AWS request failed, retrying in %s: %s", delay, err)
+		if !sleepWithContext(ctx, delay) {
+			return err
+		}
+	}
+}
+
+// sendOnce is like sendWithContext, but the SDK doesn't retry the request.
+// It's used for the requests retried by retry.
+func sendOnce(ctx context.Context, req *request.Request) error {
+	req.Retryer = client.DefaultRetryer{NumMaxRetries: 0}
+	return sendWithContext(ctx, req)
+}
+
+// sendWithContext sends the request, stopping when ctx is done. The vendored
+// SDK predates the ...WithContext API methods, so the context is attached to
+// the HTTP request, which the SDK keeps across its own retries.
+func sendWithContext(ctx context.Context, req *request.Request) error {
+	req.HTTPRequest = req.HTTPRequest.WithContext(ctx)
+
+	// The SDK retries the errors of cancelled requests like any other
+	// network error.
+	req.Handlers.Retry.PushBack(func(r *request.Request) {
+		if ctx.Err() != nil {
+			r.Retryable = aws.Bool(false)
+		}
+	})
+
+	return req.Send()
+}
+
+// withOperationTimeout returns ctx limited to the operation timeout, if one
+// is set.
+func (c *S3Client) withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.operationTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.operationTimeout)
+}
+
+// checkOperationTimeout replaces the error err points to with a timeout error
+// when the operation timeout ended the operation, whatever error the SDK
+// returned for the cancelled request. It's deferred, so that it sees the
+// operation's final error. Lock errors keep the info of the lock.
+func (c *S3Client) checkOperationTimeout(ctx context.Context, op string, err *error) {
+	if *err == nil || c.operationTimeout <= 0 || ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+
+	log.Printf("[DEBUG] S3 state %s timed out: %s", op, *err)
+	timeoutErr := wrapf(context.DeadlineExceeded, "S3 state %s timed out after %s: %s", op, c.operationTimeout, context.DeadlineExceeded)
+	if lockErr, ok := (*err).(*state.LockError); ok {
+		lockErr.Err = timeoutErr
+		return
+	}
+	*err = timeoutErr
+}
+
+// sleepWithContext sleeps for d, returning false if ctx is done first.
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func isThrottled(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return throttleCodes[awsErr.Code()]
+	}
+	return false
+}
+
+// expiredTokenCodes are the error codes returned for expired temporary
+// credentials.
+var expiredTokenCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+}
+
+func isExpiredToken(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return expiredTokenCodes[awsErr.Code()]
+	}
+	return false
+}
+
+// expireCredentials makes the clients retrieve their credentials again
+// before the next request.
+func (c *S3Client) expireCredentials() {
+	if c.nativeClient != nil && c.nativeClient.Config.Credentials != nil {
+		c.nativeClient.Config.Credentials.Expire()
+	}
+	if c.dynClient != nil && c.dynClient.Config.Credentials != nil {
+		c.dynClient.Config.Credentials.Expire()
+	}
+}
+
+// isTransient reports whether err is a throttling, server or network error,
+// or a request S3 timed out waiting for, which may succeed if retried. These
+// are the errors the SDK retries itself.
+func isTransient(err error) bool {
+	if isThrottled(err) || isNetworkError(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500 || reqErr.Code() == "RequestTimeout"
+	}
+	return false
+}
+
+// isNetworkError reports whether err is a failure to reach AWS or to read its
+// response, such as a timeout or a reset connection, rather than an error
+// returned by the service. Cancelled requests aren't network errors.
+func isNetworkError(err error) bool {
+	// The SDK wraps the errors of requests that couldn't be sent in an
+	// awserr.Error, which predates Unwrap.
+	for {
+		awsErr, ok := err.(awserr.Error)
+		if !ok {
+			break
+		}
+		if _, ok := err.(awserr.RequestFailure); ok {
+			// The service responded.
+			return false
+		}
+		err = awsErr.OrigErr()
+	}
+	if err == nil || isError(err, context.Canceled) || isError(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// *url.Error, which the HTTP client returns, is a net.Error.
+	for e := err; e != nil; e = unwrap(e) {
+		if _, ok := e.(net.Error); ok {
+			return true
+		}
+	}
+	return isError(err, syscall.ECONNRESET) || isError(err, io.ErrUnexpectedEOF)
+}
+
+// retryDelay returns an exponentially increasing delay for the given attempt,
+// with jitter so that concurrent clients don't retry in lockstep.
+func retryDelay(attempt int) time.Duration {
+	delay := retryMaxDelay
+	if attempt < 16 {
+		if d := retryMinDelay << uint(attempt); d < retryMaxDelay {
+			delay = d
+		}
+	}
+
+	// Pick a delay between half and all of the computed value.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,132 @@
+package s3
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		d := retryDelay(attempt)
+		if d < retryMinDelay/2 || d > retryMaxDelay {
+			t.Fatalf("attempt %d: delay %s out of bounds", attempt, d)
+		}
+	}
+
+	if d := retryDelay(3); d < 4*retryMinDelay || d >= 8*retryMinDelay {
+		t.Fatalf("attempt 3: expected delay in [%s, %s), got %s", 4*retryMinDelay, 8*retryMinDelay, d)
+	}
+}
+
+func TestRemoteClientRetryNetworkErrors(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.maxRetries = 2
+	stub.objects["state"] = []byte("test state")
+
+	// Each operation's first request fails with a reset connection.
+	reset := func(op string) {
+		failed := false
+		stub.handlers[op] = func(r *request.Request) {
+			if !failed {
+				failed = true
+				r.Error = awserr.New("RequestError", "send request failed", &url.Error{
+					Op:  "Put",
+					URL: "https://tf-test.s3.amazonaws.com/state",
+					Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+				})
+				return
+			}
+			stub.serve(r)
+		}
+	}
+	reset("GetObject")
+	reset("PutObject")
+
+	payload, err := c.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload.Data) != "test state" {
+		t.Fatalf("unexpected state %q", payload.Data)
+	}
+	if err := c.Put([]byte("new state")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.requests("GetObject")); n != 2 {
+		t.Fatalf("expected the read to be retried once, got %d requests", n)
+	}
+	if n := len(stub.requests("PutObject")); n != 2 {
+		t.Fatalf("expected the write to be retried once, got %d requests", n)
+	}
+
+	// Errors returned by S3 aren't network errors.
+	stub.calls = nil
+	stub.handlers["GetObject"] = func(r *request.Request) {
+		stubError(r, http.StatusForbidden, "AccessDenied")
+	}
+	if _, err := c.Get(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := len(stub.requests("GetObject")); n != 1 {
+		t.Fatalf("expected access denied not to be retried, got %d requests", n)
+	}
+}
+
+func TestRemoteClientRetryAttempts(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.maxRetries = 2
+	c.nativeClient.Retryer = client.DefaultRetryer{NumMaxRetries: 2}
+	stub.handlers["GetObject"] = func(r *request.Request) {
+		stubError(r, http.StatusInternalServerError, "InternalError")
+	}
+
+	// The request is retried by the client only, not by the SDK as well.
+	if _, err := c.Get(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := len(stub.requests("GetObject")); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+
+	// Requests the client doesn't retry are still retried by the SDK.
+	stub.calls = nil
+	stub.handlers["DeleteObject"] = func(r *request.Request) {
+		stubError(r, http.StatusInternalServerError, "InternalError")
+	}
+	if err := c.Delete(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := len(stub.requests("DeleteObject")); n != 3 {
+		t.Fatalf("expected 3 attempts, got %d", n)
+	}
+}
+
+func TestIsNetworkError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New("RequestError", "send request failed", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), true},
+		{awserr.New("RequestError", "send request failed", &url.Error{Op: "Get", URL: "https://s3", Err: io.ErrUnexpectedEOF}), true},
+		{awserr.New("RequestError", "send request failed", &url.Error{Op: "Get", URL: "https://s3", Err: context.Canceled}), false},
+		{wrapf(syscall.ECONNRESET, "read: %s", syscall.ECONNRESET), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "request-id"), false},
+		{awserr.New("SerializationError", "failed to decode", nil), false},
+		{nil, false},
+	} {
+		if got := isNetworkError(tc.err); got != tc.want {
+			t.Fatalf("%v: expected %t, got %t", tc.err, tc.want, got)
+		}
+	}
+}
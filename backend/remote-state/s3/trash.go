@@ -0,0 +1,92 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// With soft_delete, deleted state is moved to trashPrefix followed by the
+// state key and the time it was deleted, so every deleted copy is kept until
+// it's older than the retention period.
+const (
+	trashPrefix     = ".trash/"
+	trashTimeFormat = "20060102T150405Z"
+)
+
+// trashKey returns the key deleted state is moved to.
+func (c *S3Client) trashKey(deleted time.Time) string {
+	return trashPrefix + path.Join(c.keyName, deleted.UTC().Format(trashTimeFormat))
+}
+
+// moveToTrash moves the state to the trash, with the same encryption as when
+// it's written, and deletes trashed copies that have been kept long enough.
+func (c *S3Client) moveToTrash(ctx context.Context) error {
+	now := time.Now()
+	key := c.trashKey(now)
+
+	if err := c.copyState(ctx, key); err != nil {
+		// There's nothing to delete, as with a hard delete.
+		if isError(err, ErrStateNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	req, _ := c.nativeClient.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket:       &c.bucketName,
+		Key:          &c.keyName,
+		RequestPayer: c.requestPayerValue(),
+	})
+	if err := sendWithContext(ctx, req); err != nil {
+		return fmt.Errorf("State was copied to %q, but deleting it from %q failed: %s", key, c.keyName, classify(err))
+	}
+	log.Printf("[INFO] Moved deleted state %s to %q", c.StatePath(), key)
+
+	if c.trashRetention > 0 {
+		if err := c.purgeTrash(ctx, now.Add(-c.trashRetention)); err != nil {
+			log.Printf("[WARN] Unable to delete expired copies of state %s from the trash: %s", c.StatePath(), err)
+		}
+	}
+	return nil
+}
+
+// purgeTrash deletes the trashed copies of the state deleted before cutoff.
+// Their age is taken from their keys, so objects that don't have a deletion
+// time in their key are left alone.
+func (c *S3Client) purgeTrash(ctx context.Context, cutoff time.Time) error {
+	prefix := trashPrefix + c.keyName + "/"
+
+	var expired []string
+	err := c.listObjects(ctx, prefix, "/", func(page *s3.ListObjectsV2Output) {
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			deleted, err := time.Parse(trashTimeFormat, strings.TrimPrefix(key, prefix))
+			if err == nil && deleted.Before(cutoff) {
+				expired = append(expired, key)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		req, _ := c.nativeClient.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket:       &c.bucketName,
+			Key:          aws.String(key),
+			RequestPayer: c.requestPayerValue(),
+		})
+		if err := sendWithContext(ctx, req); err != nil {
+			return fmt.Errorf("Error deleting %q: %s", key, err)
+		}
+		log.Printf("[DEBUG] Deleted expired copy %q of state %s", key, c.StatePath())
+	}
+	return nil
+}
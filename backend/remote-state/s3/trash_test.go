@@ -0,0 +1,85 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRemoteClientSoftDelete(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.keyName = "env/state"
+	c.softDelete = true
+	c.serverSideEncryption = true
+	c.kmsKeyID = "arn:aws:kms:us-west-2:123456789012:key/test"
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stub.objects["env/state"]; ok {
+		t.Fatal("state is still at its original key")
+	}
+	var trashed []string
+	for key := range stub.objects {
+		if strings.HasPrefix(key, ".trash/env/state/") {
+			trashed = append(trashed, key)
+		}
+	}
+	if len(trashed) != 1 {
+		t.Fatalf("expected the state in the trash, got %v", trashed)
+	}
+	if string(stub.objects[trashed[0]]) != "test state" {
+		t.Fatalf("bad trashed state: %q", stub.objects[trashed[0]])
+	}
+
+	in := stub.requests("CopyObject")[0].Params.(*s3.CopyObjectInput)
+	if aws.StringValue(in.ServerSideEncryption) != "aws:kms" || aws.StringValue(in.SSEKMSKeyId) != c.kmsKeyID {
+		t.Fatalf("trashed state isn't encrypted like the state: %s, %s", aws.StringValue(in.ServerSideEncryption), aws.StringValue(in.SSEKMSKeyId))
+	}
+
+	// Deleting state that doesn't exist is not an error.
+	if err := c.Delete(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteClientSoftDeleteRetention(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.softDelete = true
+	c.trashRetention = 24 * time.Hour
+
+	old := c.trashKey(time.Now().Add(-48 * time.Hour))
+	recent := c.trashKey(time.Now().Add(-time.Hour))
+	stub.objects[old] = []byte("old state")
+	stub.objects[recent] = []byte("recent state")
+	stub.objects[".trash/state/restored"] = []byte("other")
+	stub.objects[".trash/state-2/20170301T120000Z"] = []byte("another key")
+
+	if err := c.Put([]byte("test state")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stub.objects[old]; ok {
+		t.Fatal("expired state was kept in the trash")
+	}
+	for _, key := range []string{recent, ".trash/state/restored", ".trash/state-2/20170301T120000Z"} {
+		if _, ok := stub.objects[key]; !ok {
+			t.Fatalf("%s was deleted from the trash", key)
+		}
+	}
+	if n := len(stub.requests("DeleteObject")); n != 2 {
+		t.Fatalf("expected the state and one expired copy to be deleted, got %d deletes", n)
+	}
+}
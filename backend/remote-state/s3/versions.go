@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// StateVersion is a version of the state object in a versioned bucket.
+type StateVersion struct {
+	// VersionID is the ID to read the version with GetVersion.
+	VersionID string
+
+	LastModified time.Time
+
+	// IsLatest is set for the current version of the state.
+	IsLatest bool
+}
+
+// ListVersions returns the versions of the state object, newest first, so a
+// version can be chosen to recover with GetVersion. Delete markers aren't
+// returned, since they can't be read.
+func (c *S3Client) ListVersions(ctx context.Context) ([]*StateVersion, error) {
+	var versions []*StateVersion
+	err := c.listObjectVersions(ctx, func(page *s3.ListObjectVersionsOutput) {
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) != c.keyName {
+				continue
+			}
+			versions = append(versions, &StateVersion{
+				VersionID:    aws.StringValue(v.VersionId),
+				LastModified: aws.TimeValue(v.LastModified),
+				IsLatest:     aws.BoolValue(v.IsLatest),
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 lists the versions of a key newest first, but the order isn't
+	// relied on.
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].LastModified.After(versions[j].LastModified)
+	})
+	return versions, nil
+}
+
+// listObjectVersions calls fn with each page of the versions and delete
+// markers of the state. The listing is by prefix, so pages also include keys
+// that start with the state's key.
+func (c *S3Client) listObjectVersions(ctx context.Context, fn func(*s3.ListObjectVersionsOutput)) error {
+	input := &s3.ListObjectVersionsInput{
+		Bucket: &c.bucketName,
+		Prefix: &c.keyName,
+	}
+
+	for {
+		var page *s3.ListObjectVersionsOutput
+		err := c.retry(ctx, func() error {
+			var req *request.Request
+			req, page = c.nativeClient.ListObjectVersionsRequest(input)
+			return sendOnce(ctx, req)
+		})
+		if err != nil {
+			return fmt.Errorf("Error listing versions of state %s: %s", c.StatePath(), classify(err))
+		}
+
+		fn(page)
+
+		if !aws.BoolValue(page.IsTruncated) {
+			return nil
+		}
+		input.KeyMarker = page.NextKeyMarker
+		input.VersionIdMarker = page.NextVersionIdMarker
+	}
+}
@@ -0,0 +1,175 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/backend"
+	"github.com/hashicorp/terraform/state/remote"
+)
+
+const (
+	// workspaceStateWorkers is the most workspace states that
+	// GetAllWorkspaceStates reads at once.
+	workspaceStateWorkers = 8
+
+	// workspacePlaceholder is replaced by the workspace name in key_template.
+	workspacePlaceholder = "{workspace}"
+)
+
+// renderKeyTemplate returns the key of the named workspace's state laid out
+// by key_template.
+func renderKeyTemplate(tmpl, name string) string {
+	return normalizeKey(strings.Replace(tmpl, workspacePlaceholder, name, -1))
+}
+
+// workspaceKey returns the key of the state of the named workspace.
+func (c *S3Client) workspaceKey(name string) string {
+	if c.keyTemplate != "" {
+		return renderKeyTemplate(c.keyTemplate, name)
+	}
+	sep := c.workspaceSeparator()
+	return keyEnvPrefix + sep + name + sep + c.keyName
+}
+
+// workspaceClient returns a copy of the client for the state of the named
+// workspace, which only differs in the key, and so in the lock path. The
+// ETag of the client's own state isn't kept.
+func (c *S3Client) workspaceClient(name string) *S3Client {
+	wc := *c
+	wc.keyName = c.workspaceKey(name)
+	wc.etag = ""
+	return &wc
+}
+
+// workspaceSeparator returns the separator of the parts of workspace keys.
+func (c *S3Client) workspaceSeparator() string {
+	if c.workspaceSep == "" {
+		return "/"
+	}
+	return c.workspaceSep
+}
+
+// workspaceNames returns the names of the named workspaces. With key_template
+// or another workspace_key_separator than "/" they're found by matching the
+// keys of the states, so only workspaces with state are found.
+func (c *S3Client) workspaceNames(ctx context.Context) ([]string, error) {
+	if c.keyTemplate == "" {
+		sep := c.workspaceSeparator()
+		if sep != "/" {
+			return c.matchWorkspaceKeys(ctx, keyEnvPrefix+sep, sep+c.keyName)
+		}
+
+		dirs, err := c.listWorkspaces(ctx, keyEnvPrefix)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, name := range dirs {
+			if name != backend.DefaultStateName {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+
+	i := strings.Index(c.keyTemplate, workspacePlaceholder)
+	prefix := normalizeKey(c.keyTemplate[:i])
+	if prefix != "" && strings.HasSuffix(c.keyTemplate[:i], "/") {
+		prefix += "/"
+	}
+	return c.matchWorkspaceKeys(ctx, prefix, c.keyTemplate[i+len(workspacePlaceholder):])
+}
+
+// matchWorkspaceKeys returns the names of the workspaces whose state keys are
+// the workspace name between prefix and suffix.
+func (c *S3Client) matchWorkspaceKeys(ctx context.Context, prefix, suffix string) ([]string, error) {
+	keys, err := c.listAllKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, suffix) || len(key) <= len(prefix)+len(suffix) {
+			continue
+		}
+		name := key[len(prefix) : len(key)-len(suffix)]
+		if name == backend.DefaultStateName || strings.Contains(name, "/") || c.workspaceKey(name) != key {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// GetAllWorkspaceStates reads the states of all named workspaces, the ones
+// besides the default state that States lists. See
+// S3Client.GetAllWorkspaceStates.
+func (b *Backend) GetAllWorkspaceStates(ctx context.Context) (map[string]*remote.Payload, error) {
+	return b.client.GetAllWorkspaceStates(ctx)
+}
+
+// GetAllWorkspaceStates reads the states of all named workspaces, several at
+// a time, returning them by workspace name. A workspace without state has a
+// nil payload. Failing to read some of the states doesn't stop the others
+// from being read; the states that were read are returned along with an
+// error for each that wasn't.
+func (c *S3Client) GetAllWorkspaceStates(ctx context.Context) (map[string]*remote.Payload, error) {
+	names, err := c.workspaceNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	work := make(chan string)
+	go func() {
+		defer close(work)
+		for _, name := range names {
+			work <- name
+		}
+	}()
+
+	var mu sync.Mutex
+	states := make(map[string]*remote.Payload, len(names))
+	failed := make(map[string]error)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workspaceStateWorkers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				payload, err := c.workspaceClient(name).GetWithContext(ctx)
+
+				mu.Lock()
+				if err != nil {
+					failed[name] = err
+				} else {
+					states[name] = payload
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		return states, nil
+	}
+
+	failedNames := make([]string, 0, len(failed))
+	for name := range failed {
+		failedNames = append(failedNames, name)
+	}
+	sort.Strings(failedNames)
+
+	errs := make([]error, 0, len(failed))
+	for _, name := range failedNames {
+		errs = append(errs, fmt.Errorf("workspace %q: %s", name, failed[name]))
+	}
+	return states, &multierror.Error{Errors: errs}
+}
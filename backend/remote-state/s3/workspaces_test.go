@@ -0,0 +1,275 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/backend"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/state"
+)
+
+func TestRemoteClientGetAllWorkspaceStates(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+
+	for i := 0; i < 10; i++ {
+		stub.objects[fmt.Sprintf("-env:/ws%d/state", i)] = []byte(fmt.Sprintf("state %d", i))
+	}
+	stub.objects["-env:/empty/other"] = []byte("not the state")
+	stub.objects["state"] = []byte("default state")
+
+	var inFlight, maxInFlight int32
+	stub.handlers["GetObject"] = func(r *request.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		key := *r.Params.(*s3.GetObjectInput).Key
+		if key == "-env:/ws3/state" || key == "-env:/ws7/state" {
+			stubError(r, 500, "InternalError")
+			return
+		}
+		stub.serve(r)
+	}
+
+	states, err := c.GetAllWorkspaceStates(context.Background())
+
+	merr, ok := err.(*multierror.Error)
+	if !ok || len(merr.Errors) != 2 {
+		t.Fatalf("expected 2 errors, got %#v", err)
+	}
+	if !strings.Contains(merr.Errors[0].Error(), `workspace "ws3"`) || !strings.Contains(merr.Errors[1].Error(), `workspace "ws7"`) {
+		t.Fatalf("errors don't name the workspaces: %s", err)
+	}
+
+	if len(states) != 8 {
+		t.Fatalf("expected 8 states, got %d: %#v", len(states), states)
+	}
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("ws%d", i)
+		if i == 3 || i == 7 {
+			if _, ok := states[name]; ok {
+				t.Fatalf("unexpected state of %s", name)
+			}
+			continue
+		}
+		if got := string(states[name].Data); got != fmt.Sprintf("state %d", i) {
+			t.Fatalf("bad state of %s: %q", name, got)
+		}
+	}
+	// A "directory" under the prefix without the state isn't a workspace.
+	if _, ok := states["empty"]; ok {
+		t.Fatal("unexpected state of a directory without the state")
+	}
+
+	if max := atomic.LoadInt32(&maxInFlight); max < 2 || max > workspaceStateWorkers {
+		t.Fatalf("expected between 2 and %d concurrent reads, got %d", workspaceStateWorkers, max)
+	}
+	if c.keyName != "state" {
+		t.Fatalf("client key changed to %q", c.keyName)
+	}
+}
+
+func TestBackendConfig_keyTemplate(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                 "us-west-1",
+		"bucket":                 "tf-test",
+		"key_template":           "states/{workspace}/terraform.tfstate",
+		"access_key":             "ACCESS_KEY",
+		"secret_key":             "SECRET_KEY",
+		"skip_bucket_validation": true,
+	}
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+
+	if b.client.keyName != "states/default/terraform.tfstate" {
+		t.Fatalf("unexpected key of the default workspace: %q", b.client.keyName)
+	}
+	if key := b.client.workspaceKey("dev"); key != "states/dev/terraform.tfstate" {
+		t.Fatalf("unexpected key of the dev workspace: %q", key)
+	}
+
+	for name, config := range map[string]map[string]interface{}{
+		"no placeholder": {"key_template": "states/terraform.tfstate"},
+		"with key":       {"key_template": "states/{workspace}/terraform.tfstate", "key": "state"},
+		"no key":         {},
+	} {
+		config["region"] = "us-west-1"
+		config["bucket"] = "tf-test"
+		if err := testBackendConfigErr(t, config); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+// Terraform rejects interpolations in backend configuration, so the
+// placeholder mustn't look like one.
+func TestBackendConfig_keyTemplateNotInterpolated(t *testing.T) {
+	rc, err := config.NewRawConfig(map[string]interface{}{
+		"bucket":       "tf-test",
+		"key_template": "states/{workspace}/terraform.tfstate",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := (&config.Backend{Type: "s3", RawConfig: rc}).Validate(); len(errs) > 0 {
+		t.Fatalf("expected the template to be accepted, got %v", errs)
+	}
+}
+
+func TestRemoteClientGetAllWorkspaceStates_keyTemplate(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.keyTemplate = "states/{workspace}/terraform.tfstate"
+	c.keyName = renderKeyTemplate(c.keyTemplate, "default")
+
+	stub.objects["states/default/terraform.tfstate"] = []byte("default state")
+	stub.objects["states/dev/terraform.tfstate"] = []byte("dev state")
+	stub.objects["states/prod/terraform.tfstate"] = []byte("prod state")
+	stub.objects["states/prod/other"] = []byte("not the state")
+
+	states, err := c.GetAllWorkspaceStates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected the states of dev and prod, got %#v", states)
+	}
+	for _, name := range []string{"dev", "prod"} {
+		if got := string(states[name].Data); got != name+" state" {
+			t.Fatalf("bad state of %s: %q", name, got)
+		}
+	}
+}
+
+func TestBackendGetAllWorkspaceStates(t *testing.T) {
+	stub := newStubAWS()
+	b := &Backend{client: stub.client()}
+
+	for _, name := range []string{"dev", "prod"} {
+		if _, err := b.State(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A workspace can't be named like the default state.
+	stub.objects["-env:/default/state"] = []byte("not a workspace")
+
+	states, err := b.GetAllWorkspaceStates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states["dev"] == nil || states["prod"] == nil {
+		t.Fatalf("expected the states of dev and prod, got %#v", states)
+	}
+}
+
+func TestRemoteClientWorkspaceKeySeparator(t *testing.T) {
+	stub := newStubAWS()
+	c := stub.client()
+	c.workspaceSep = "--"
+
+	wc := c.workspaceClient("dev")
+	if wc.keyName != "-env:--dev--state" {
+		t.Fatalf("unexpected key of the dev workspace: %q", wc.keyName)
+	}
+	if path := wc.LockPath(); path != "tf-test/-env:--dev--state" {
+		t.Fatalf("unexpected lock path of the dev workspace: %q", path)
+	}
+
+	if err := wc.Put([]byte("dev state")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.objects["-env:--dev--state"]; !ok {
+		t.Fatalf("state wasn't written with the separator: %v", stub.objects)
+	}
+	id, err := wc.Lock(state.NewLockInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.items["tf-test/-env:--dev--state"]; !ok {
+		t.Fatalf("lock wasn't written with the separator: %v", stub.items)
+	}
+	if err := wc.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Names containing the separator are found by the key of their state.
+	stub.objects["-env:--my--ws--state"] = []byte("my--ws state")
+	stub.objects["-env:--prod--other"] = []byte("not the state")
+	states, err := c.GetAllWorkspaceStates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected the states of dev and my--ws, got %#v", states)
+	}
+	for _, name := range []string{"dev", "my--ws"} {
+		if got := string(states[name].Data); got != name+" state" {
+			t.Fatalf("bad state of %s: %q", name, got)
+		}
+	}
+}
+
+func TestBackendConfig_workspaceKeySeparator(t *testing.T) {
+	config := map[string]interface{}{
+		"region":                  "us-west-1",
+		"bucket":                  "tf-test",
+		"key":                     "state",
+		"workspace_key_separator": "--",
+		"access_key":              "ACCESS_KEY",
+		"secret_key":              "SECRET_KEY",
+		"skip_bucket_validation":  true,
+	}
+	b := backend.TestBackendConfig(t, New(), config).(*Backend)
+	if key := b.client.workspaceKey("dev"); key != "-env:--dev--state" {
+		t.Fatalf("unexpected key of the dev workspace: %q", key)
+	}
+
+	// The backend's named states use the separator, for the state and the
+	// lock alike.
+	stub := newStubAWS()
+	stub.install(b.client.nativeClient.Client)
+	stub.install(b.client.dynClient.Client)
+	if path, _ := b.StatePath("dev"); path != "tf-test/-env:--dev--state" {
+		t.Fatalf("unexpected state path of the dev workspace: %q", path)
+	}
+	if path, _ := b.LockPath("dev"); path != "tf-test/-env:--dev--state" {
+		t.Fatalf("unexpected lock path of the dev workspace: %q", path)
+	}
+	if _, err := b.State("dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stub.objects["-env:--dev--state"]; !ok {
+		t.Fatalf("state wasn't written with the separator: %v", stub.objects)
+	}
+	states, err := b.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[1] != "dev" {
+		t.Fatalf("expected the default and dev states, got %q", states)
+	}
+
+	err = testBackendConfigErr(t, map[string]interface{}{
+		"region":                  "us-west-1",
+		"bucket":                  "tf-test",
+		"key_template":            "states/{workspace}/terraform.tfstate",
+		"workspace_key_separator": "--",
+	})
+	if err == nil {
+		t.Fatal("expected an error using workspace_key_separator with key_template")
+	}
+}
@@ -1,11 +1,21 @@
 package aws
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,6 +24,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -95,6 +106,20 @@ func parseAccountInfoFromArn(arn string) (string, string, error) {
 // environment in the case that they're not explicitly specified
 // in the Terraform configuration.
 func GetCredentials(c *Config) (*awsCredentials.Credentials, error) {
+	// A configured web identity token is exchanged for role credentials
+	// directly, without needing any other credentials. One from the
+	// environment is only used when there are no static, environment or
+	// shared credentials, below.
+	webIdentity, err := newWebIdentityRoleProvider(c)
+	if err != nil {
+		return nil, err
+	}
+	if webIdentity != nil && c.WebIdentityTokenFile != "" {
+		log.Printf("[INFO] Assuming role %s with web identity token file %s",
+			webIdentity.RoleARN, webIdentity.TokenFile)
+		return awsCredentials.NewCredentials(webIdentity), nil
+	}
+
 	// build a chain provider, lazy-evaulated by aws-sdk
 	providers := []awsCredentials.Provider{
 		&awsCredentials.StaticProvider{Value: awsCredentials.Value{
@@ -109,6 +134,31 @@ func GetCredentials(c *Config) (*awsCredentials.Credentials, error) {
 		},
 	}
 
+	// An explicitly configured credential process takes precedence over
+	// credentials from the environment.
+	if c.CredentialProcess != "" {
+		providers = append(providers[:1], append([]awsCredentials.Provider{
+			&CredentialProcessProvider{Command: c.CredentialProcess},
+		}, providers[1:]...)...)
+	}
+
+	if webIdentity != nil {
+		log.Printf("[INFO] Web identity token file %s for role %s added to the auth chain",
+			webIdentity.TokenFile, webIdentity.RoleARN)
+		providers = append(providers, webIdentity)
+	}
+
+	// ECS task roles and EKS Pod Identity serve credentials from a container
+	// endpoint, which takes precedence over the instance's role. An endpoint
+	// that can't be used is left out rather than failing other credentials.
+	container, err := newContainerCredentialsProvider()
+	if err != nil {
+		log.Printf("[WARN] Ignoring container credentials endpoint: %s", err)
+	} else if container != nil {
+		log.Printf("[INFO] Container credentials endpoint %s added to the auth chain", container.Endpoint)
+		providers = append(providers, container)
+	}
+
 	// Build isolated HTTP client to avoid issues with globally-shared settings
 	client := cleanhttp.DefaultClient()
 
@@ -118,12 +168,17 @@ func GetCredentials(c *Config) (*awsCredentials.Credentials, error) {
 		HTTPClient: client,
 	}
 	usedEndpoint := setOptionalEndpoint(cfg)
+	if usedEndpoint == "" && c.Ec2MetadataServiceEndpointMode == ec2MetadataEndpointModeIPv6 {
+		cfg.Endpoint = aws.String(ec2MetadataEndpointIPv6)
+		usedEndpoint = ec2MetadataEndpointIPv6
+	}
 
 	if !c.SkipMetadataApiCheck {
 		// Real AWS should reply to a simple metadata request.
 		// We check it actually does to ensure something else didn't just
 		// happen to be listening on the same IP:Port
 		metadataClient := ec2metadata.New(session.New(cfg))
+		useEC2MetadataToken(metadataClient, !c.Ec2MetadataDisableFallback)
 		if metadataClient.Available() {
 			providers = append(providers, &ec2rolecreds.EC2RoleProvider{
 				Client: metadataClient,
@@ -163,6 +218,12 @@ func GetCredentials(c *Config) (*awsCredentials.Credentials, error) {
 
 	log.Printf("[INFO] AWS Auth provider used: %q", cp.ProviderName)
 
+	// The web identity token from the environment was already exchanged
+	// for credentials of the role.
+	if cp.ProviderName == WebIdentityRoleProviderName && webIdentity.RoleARN == c.AssumeRoleARN {
+		return creds, nil
+	}
+
 	awsConfig := &aws.Config{
 		Credentials:      creds,
 		Region:           aws.String(c.Region),
@@ -170,26 +231,38 @@ func GetCredentials(c *Config) (*awsCredentials.Credentials, error) {
 		HTTPClient:       cleanhttp.DefaultClient(),
 		S3ForcePathStyle: aws.Bool(c.S3ForcePathStyle),
 	}
-
-	stsclient := sts.New(session.New(awsConfig))
-	assumeRoleProvider := &stscreds.AssumeRoleProvider{
-		Client:  stsclient,
-		RoleARN: c.AssumeRoleARN,
+	if c.StsEndpoint != "" {
+		awsConfig.Endpoint = aws.String(c.StsEndpoint)
 	}
-	if c.AssumeRoleSessionName != "" {
-		assumeRoleProvider.RoleSessionName = c.AssumeRoleSessionName
-	}
-	if c.AssumeRoleExternalID != "" {
-		assumeRoleProvider.ExternalID = aws.String(c.AssumeRoleExternalID)
-	}
-	if c.AssumeRolePolicy != "" {
-		assumeRoleProvider.Policy = aws.String(c.AssumeRolePolicy)
+
+	return assumeRole(c, awsConfig)
+}
+
+// assumeRole returns credentials for the role c.AssumeRoleARN, assumed with
+// the credentials of awsConfig. When c.AssumeRoleSourceARN is set, that role
+// is assumed first, and its credentials are used to assume the target role.
+func assumeRole(c *Config, awsConfig *aws.Config) (*awsCredentials.Credentials, error) {
+	if c.AssumeRoleSourceARN != "" {
+		log.Printf("[INFO] Attempting to AssumeRole %s before assuming %s",
+			c.AssumeRoleSourceARN, c.AssumeRoleARN)
+
+		sourceCreds := awsCredentials.NewCredentials(&stscreds.AssumeRoleProvider{
+			Client:          sts.New(session.New(awsConfig)),
+			RoleARN:         c.AssumeRoleSourceARN,
+			RoleSessionName: c.AssumeRoleSessionName,
+		})
+		if _, err := sourceCreds.Get(); err != nil {
+			return nil, fmt.Errorf("Error assuming source role %q: %s", c.AssumeRoleSourceARN, err)
+		}
+
+		awsConfig = awsConfig.Copy(&aws.Config{Credentials: sourceCreds})
 	}
 
-	providers = []awsCredentials.Provider{assumeRoleProvider}
+	stsclient := sts.New(session.New(awsConfig))
+	providers := []awsCredentials.Provider{newAssumeRoleProvider(c, stsclient)}
 
 	assumeRoleCreds := awsCredentials.NewChainCredentials(providers)
-	_, err = assumeRoleCreds.Get()
+	_, err := assumeRoleCreds.Get()
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoCredentialProviders" {
 			return nil, fmt.Errorf("The role %q cannot be assumed.\n\n"+
@@ -206,6 +279,37 @@ func GetCredentials(c *Config) (*awsCredentials.Credentials, error) {
 	return assumeRoleCreds, nil
 }
 
+// newAssumeRoleProvider returns the provider of credentials for the role
+// c.AssumeRoleARN.
+func newAssumeRoleProvider(c *Config, client *sts.STS) *stscreds.AssumeRoleProvider {
+	p := &stscreds.AssumeRoleProvider{
+		Client:  client,
+		RoleARN: c.AssumeRoleARN,
+	}
+	if c.AssumeRoleSessionName != "" {
+		p.RoleSessionName = c.AssumeRoleSessionName
+	}
+	if c.AssumeRoleExternalID != "" {
+		p.ExternalID = aws.String(c.AssumeRoleExternalID)
+	}
+	if c.AssumeRolePolicy != "" {
+		p.Policy = aws.String(c.AssumeRolePolicy)
+	}
+	if c.AssumeRoleSerialNumber != "" {
+		p.SerialNumber = aws.String(c.AssumeRoleSerialNumber)
+		if c.AssumeRoleTokenCode != "" {
+			p.TokenCode = aws.String(c.AssumeRoleTokenCode)
+		}
+		p.TokenProvider = c.AssumeRoleTokenProvider
+	}
+	if c.AssumeRoleDuration != 0 {
+		p.Duration = c.AssumeRoleDuration
+		// Refresh the credentials shortly before they expire.
+		p.ExpiryWindow = c.AssumeRoleDuration / 10
+	}
+	return p
+}
+
 func setOptionalEndpoint(cfg *aws.Config) string {
 	endpoint := os.Getenv("AWS_METADATA_URL")
 	if endpoint != "" {
@@ -215,3 +319,406 @@ func setOptionalEndpoint(cfg *aws.Config) string {
 	}
 	return ""
 }
+
+const (
+	ec2MetadataEndpointModeIPv6 = "IPv6"
+
+	// The IPv6 endpoint of the EC2 metadata API, available on Nitro
+	// instances.
+	ec2MetadataEndpointIPv6 = "http://[fd00:ec2::254]/latest"
+
+	// How long IMDSv2 session tokens are requested for.
+	ec2MetadataTokenTTL = 6 * time.Hour
+)
+
+// ec2MetadataToken fetches IMDSv2 session tokens and adds them to the
+// requests of an EC2 metadata client. Instances that enforce IMDSv2 reject
+// metadata requests without a token.
+type ec2MetadataToken struct {
+	client *ec2metadata.EC2Metadata
+
+	// fallback allows requests to be sent without a token, as IMDSv1
+	// permits, when no token can be fetched.
+	fallback bool
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// useEC2MetadataToken makes every request of the metadata client carry an
+// IMDSv2 session token.
+func useEC2MetadataToken(client *ec2metadata.EC2Metadata, fallback bool) {
+	t := &ec2MetadataToken{client: client, fallback: fallback}
+	client.Handlers.Build.PushBack(t.handler)
+}
+
+func (t *ec2MetadataToken) handler(r *request.Request) {
+	token, err := t.get()
+	if err != nil {
+		if t.fallback {
+			log.Printf("[DEBUG] Unable to fetch EC2 metadata token, falling back to IMDSv1: %s", err)
+			return
+		}
+		r.Error = awserr.New("EC2MetadataError", "failed to fetch EC2 metadata token", err)
+		return
+	}
+
+	r.HTTPRequest.Header.Set("X-aws-ec2-metadata-token", token)
+}
+
+// get returns the current token, fetching a new one if it has expired.
+func (t *ec2MetadataToken) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequest("PUT", t.client.Endpoint+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	ttl := int(ec2MetadataTokenTTL / time.Second)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(ttl))
+
+	resp, err := t.client.Config.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// Renew the token a minute early so it can't expire in flight.
+	t.token = strings.TrimSpace(string(body))
+	t.expires = time.Now().Add(ec2MetadataTokenTTL - time.Minute)
+	return t.token, nil
+}
+
+// CredentialProcessProviderName is the name of CredentialProcessProvider.
+const CredentialProcessProviderName = "CredentialProcessProvider"
+
+// CredentialProcessProvider retrieves credentials from the JSON output of an
+// external command, in the format of the credential_process setting of the
+// AWS shared config file. The command is run again once the credentials it
+// returned expire.
+type CredentialProcessProvider struct {
+	awsCredentials.Expiry
+
+	// Command is run by the shell.
+	Command string
+}
+
+// credentialProcessOutput is the JSON printed by a credential process.
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+func (p *CredentialProcessProvider) Retrieve() (awsCredentials.Value, error) {
+	value := awsCredentials.Value{ProviderName: CredentialProcessProviderName}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd.exe", "/C", p.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", p.Command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Env = os.Environ()
+
+	out, err := cmd.Output()
+	if err != nil {
+		return value, fmt.Errorf("credential process %q failed: %s: %s",
+			p.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var creds credentialProcessOutput
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return value, fmt.Errorf("credential process %q returned invalid JSON: %s", p.Command, err)
+	}
+	if creds.Version != 1 {
+		return value, fmt.Errorf("credential process %q returned unsupported version %d", p.Command, creds.Version)
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return value, fmt.Errorf("credential process %q returned no AccessKeyId or SecretAccessKey", p.Command)
+	}
+
+	// Credentials without an expiration never need refreshing.
+	if creds.Expiration != nil {
+		p.SetExpiration(*creds.Expiration, 0)
+	} else {
+		p.SetExpiration(time.Now().AddDate(100, 0, 0), 0)
+	}
+
+	value.AccessKeyID = creds.AccessKeyId
+	value.SecretAccessKey = creds.SecretAccessKey
+	value.SessionToken = creds.SessionToken
+	return value, nil
+}
+
+// WebIdentityRoleProviderName is the name of WebIdentityRoleProvider.
+const WebIdentityRoleProviderName = "WebIdentityRoleProvider"
+
+// WebIdentityRoleProvider retrieves credentials by assuming a role with an
+// OIDC token read from a file, as provided by EKS or CI systems. The file is
+// read again on every refresh, since these tokens are rotated.
+type WebIdentityRoleProvider struct {
+	awsCredentials.Expiry
+
+	Client          *sts.STS
+	RoleARN         string
+	RoleSessionName string
+	TokenFile       string
+	Policy          string
+
+	// ExpiryWindow refreshes the credentials this long before they expire.
+	ExpiryWindow time.Duration
+}
+
+// newWebIdentityRoleProvider returns a WebIdentityRoleProvider if a web
+// identity token file is configured, falling back to the
+// AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN environment variables when no
+// static credentials are configured. It returns nil otherwise. The fallback
+// is only used after the environment and shared credentials, in the chain
+// built by GetCredentials.
+func newWebIdentityRoleProvider(c *Config) (*WebIdentityRoleProvider, error) {
+	tokenFile := c.WebIdentityTokenFile
+	roleARN := c.AssumeRoleARN
+	if tokenFile == "" {
+		if c.AccessKey != "" {
+			return nil, nil
+		}
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		if tokenFile == "" {
+			return nil, nil
+		}
+		if roleARN == "" {
+			roleARN = os.Getenv("AWS_ROLE_ARN")
+		}
+		if roleARN == "" {
+			log.Printf("[INFO] Ignoring AWS_WEB_IDENTITY_TOKEN_FILE, as no role ARN is set")
+			return nil, nil
+		}
+	}
+	if roleARN == "" {
+		return nil, fmt.Errorf("A role ARN is required to use the web identity token file %q", tokenFile)
+	}
+
+	sessionName := c.AssumeRoleSessionName
+	if sessionName == "" {
+		sessionName = os.Getenv("AWS_ROLE_SESSION_NAME")
+	}
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("terraform-%d", time.Now().UnixNano())
+	}
+
+	// AssumeRoleWithWebIdentity requests are unsigned.
+	awsConfig := &aws.Config{
+		Credentials: awsCredentials.AnonymousCredentials,
+		Region:      aws.String(c.Region),
+		MaxRetries:  aws.Int(c.MaxRetries),
+		HTTPClient:  cleanhttp.DefaultClient(),
+	}
+	if c.StsEndpoint != "" {
+		awsConfig.Endpoint = aws.String(c.StsEndpoint)
+	}
+	client := sts.New(session.New(awsConfig))
+
+	return &WebIdentityRoleProvider{
+		Client:          client,
+		RoleARN:         roleARN,
+		RoleSessionName: sessionName,
+		TokenFile:       tokenFile,
+		Policy:          c.AssumeRolePolicy,
+		ExpiryWindow:    stscreds.DefaultDuration / 10,
+	}, nil
+}
+
+func (p *WebIdentityRoleProvider) Retrieve() (awsCredentials.Value, error) {
+	value := awsCredentials.Value{ProviderName: WebIdentityRoleProviderName}
+
+	token, err := ioutil.ReadFile(p.TokenFile)
+	if err != nil {
+		return value, fmt.Errorf("Error reading web identity token file: %s", err)
+	}
+
+	input := &sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.RoleARN),
+		RoleSessionName:  aws.String(p.RoleSessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	}
+	if p.Policy != "" {
+		input.Policy = aws.String(p.Policy)
+	}
+
+	out, err := p.Client.AssumeRoleWithWebIdentity(input)
+	if err != nil {
+		return value, err
+	}
+
+	p.SetExpiration(aws.TimeValue(out.Credentials.Expiration), p.ExpiryWindow)
+
+	value.AccessKeyID = aws.StringValue(out.Credentials.AccessKeyId)
+	value.SecretAccessKey = aws.StringValue(out.Credentials.SecretAccessKey)
+	value.SessionToken = aws.StringValue(out.Credentials.SessionToken)
+	return value, nil
+}
+
+// ContainerCredentialsProviderName is the name of
+// ContainerCredentialsProvider.
+const ContainerCredentialsProviderName = "ContainerCredentialsProvider"
+
+// The host of the ECS task role endpoint, which relative container
+// credentials URIs are resolved against.
+const containerCredentialsHost = "http://169.254.170.2"
+
+// containerCredentialsHosts are the link-local hosts of the ECS and EKS Pod
+// Identity agents, which full container credentials URIs may use plain HTTP
+// for, along with loopback addresses.
+var containerCredentialsHosts = map[string]bool{
+	"169.254.170.2":  true,
+	"169.254.170.23": true,
+	"fd00:ec2::23":   true,
+}
+
+// ContainerCredentialsProvider retrieves credentials from the container
+// credentials endpoint, as provided by ECS task roles and EKS Pod Identity.
+// The authorization token file is read again on every refresh, since these
+// tokens are rotated.
+type ContainerCredentialsProvider struct {
+	awsCredentials.Expiry
+
+	Client   *http.Client
+	Endpoint string
+
+	// Token or, taking precedence, the contents of TokenFile are sent as
+	// the Authorization header.
+	Token     string
+	TokenFile string
+
+	// ExpiryWindow refreshes the credentials this long before they expire.
+	ExpiryWindow time.Duration
+}
+
+// containerCredentialsOutput is the JSON returned by the container
+// credentials endpoint.
+type containerCredentialsOutput struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      *time.Time
+
+	Code    string
+	Message string
+}
+
+// newContainerCredentialsProvider returns a ContainerCredentialsProvider if
+// the AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI environment variables are set, as they
+// are in ECS tasks and EKS pods with a Pod Identity association. It returns
+// nil otherwise.
+func newContainerCredentialsProvider() (*ContainerCredentialsProvider, error) {
+	var endpoint string
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = containerCredentialsHost + relative
+	} else if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		u, err := url.Parse(full)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing AWS_CONTAINER_CREDENTIALS_FULL_URI: %s", err)
+		}
+		if u.Scheme != "https" && !isContainerCredentialsHost(u.Hostname()) {
+			return nil, fmt.Errorf("AWS_CONTAINER_CREDENTIALS_FULL_URI %q must use HTTPS, "+
+				"or a loopback or container credentials agent address", full)
+		}
+		endpoint = full
+	} else {
+		return nil, nil
+	}
+
+	client := cleanhttp.DefaultClient()
+	client.Timeout = 5 * time.Second
+
+	return &ContainerCredentialsProvider{
+		Client:       client,
+		Endpoint:     endpoint,
+		Token:        os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+		TokenFile:    os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+		ExpiryWindow: 5 * time.Minute,
+	}, nil
+}
+
+// isContainerCredentialsHost returns true if plain HTTP may be used to reach
+// host for container credentials.
+func isContainerCredentialsHost(host string) bool {
+	if containerCredentialsHosts[host] || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (p *ContainerCredentialsProvider) Retrieve() (awsCredentials.Value, error) {
+	value := awsCredentials.Value{ProviderName: ContainerCredentialsProviderName}
+
+	req, err := http.NewRequest("GET", p.Endpoint, nil)
+	if err != nil {
+		return value, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token := p.Token
+	if p.TokenFile != "" {
+		data, err := ioutil.ReadFile(p.TokenFile)
+		if err != nil {
+			return value, fmt.Errorf("Error reading container authorization token file: %s", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return value, fmt.Errorf("Error requesting container credentials: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var creds containerCredentialsOutput
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return value, fmt.Errorf("Error decoding container credentials (%s): %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return value, fmt.Errorf("Error requesting container credentials (%s): %s: %s",
+			resp.Status, creds.Code, creds.Message)
+	}
+	if creds.AccessKeyId == "" || creds.SecretAccessKey == "" {
+		return value, errors.New("Container credentials endpoint returned no AccessKeyId or SecretAccessKey")
+	}
+
+	// Credentials without an expiration never need refreshing.
+	if creds.Expiration != nil {
+		p.SetExpiration(*creds.Expiration, p.ExpiryWindow)
+	} else {
+		p.SetExpiration(time.Now().AddDate(100, 0, 0), 0)
+	}
+
+	value.AccessKeyID = creds.AccessKeyId
+	value.SecretAccessKey = creds.SecretAccessKey
+	value.SessionToken = creds.Token
+	return value, nil
+}
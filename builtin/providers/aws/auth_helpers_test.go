@@ -7,10 +7,17 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsCredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -651,6 +658,529 @@ func TestAWSGetCredentials_shouldBeENV(t *testing.T) {
 	}
 }
 
+func TestAWSGetCredentials_shouldBeCredentialProcess(t *testing.T) {
+	resetEnv := setEnv("some_env", t)
+	defer resetEnv()
+
+	script := writeCredentialProcess(t, `echo '{"Version": 1, "AccessKeyId": "processkey", "SecretAccessKey": "processsecret", "SessionToken": "processtoken"}'`)
+	defer os.Remove(script)
+
+	creds, err := GetCredentials(&Config{CredentialProcess: script})
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	if v.ProviderName != CredentialProcessProviderName {
+		t.Fatalf("Expected provider %s, got %s", CredentialProcessProviderName, v.ProviderName)
+	}
+	if v.AccessKeyID != "processkey" {
+		t.Fatalf("AccessKeyID mismatch, expected: (%s), got (%s)", "processkey", v.AccessKeyID)
+	}
+	if v.SecretAccessKey != "processsecret" {
+		t.Fatalf("SecretAccessKey mismatch, expected: (%s), got (%s)", "processsecret", v.SecretAccessKey)
+	}
+	if v.SessionToken != "processtoken" {
+		t.Fatalf("SessionToken mismatch, expected: (%s), got (%s)", "processtoken", v.SessionToken)
+	}
+}
+
+func TestAWSGetCredentials_credentialProcessRefresh(t *testing.T) {
+	resetEnv := unsetEnv(t)
+	defer resetEnv()
+
+	runLog, err := ioutil.TempFile(os.TempDir(), "terraform_aws_cred")
+	if err != nil {
+		t.Fatalf("Error creating temporary file: %s", err)
+	}
+	runLog.Close()
+	defer os.Remove(runLog.Name())
+
+	// The credentials are already expired, so every Get runs the process.
+	script := writeCredentialProcess(t, fmt.Sprintf(`echo run >> %s
+echo '{"Version": 1, "AccessKeyId": "processkey", "SecretAccessKey": "processsecret", "Expiration": "2000-01-01T00:00:00Z"}'`, runLog.Name()))
+	defer os.Remove(script)
+
+	creds, err := GetCredentials(&Config{CredentialProcess: script})
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := creds.Get(); err != nil {
+			t.Fatalf("Error gettings creds: %s", err)
+		}
+	}
+
+	runs, err := ioutil.ReadFile(runLog.Name())
+	if err != nil {
+		t.Fatalf("Error reading temporary file: %s", err)
+	}
+	if string(runs) != "run\nrun\n" {
+		t.Fatalf("Expected the credential process to run twice, got %q", runs)
+	}
+}
+
+func TestAWSGetCredentials_credentialProcessError(t *testing.T) {
+	resetEnv := unsetEnv(t)
+	defer resetEnv()
+
+	script := writeCredentialProcess(t, `echo "no credentials for you" >&2
+exit 1`)
+	defer os.Remove(script)
+
+	creds, err := GetCredentials(&Config{CredentialProcess: script})
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+
+	p := &CredentialProcessProvider{Command: script}
+	if _, err := p.Retrieve(); err == nil || !strings.Contains(err.Error(), "no credentials for you") {
+		t.Fatalf("Expected error with the process output, got: %v", err)
+	}
+
+	// The failing process falls through to the rest of the chain, which has
+	// no credentials either.
+	if _, err := creds.Get(); err == nil {
+		t.Fatal("Expected an error from a failing credential process")
+	}
+}
+
+func TestAWSGetCredentials_webIdentityProvider(t *testing.T) {
+	resetEnv := unsetEnv(t)
+	defer resetEnv()
+	os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	os.Unsetenv("AWS_ROLE_ARN")
+	os.Unsetenv("AWS_ROLE_SESSION_NAME")
+
+	// Nothing configured
+	p, err := newWebIdentityRoleProvider(&Config{})
+	if err != nil {
+		t.Fatalf("Error creating web identity provider: %s", err)
+	}
+	if p != nil {
+		t.Fatal("Expected no web identity provider without a token file")
+	}
+
+	// Explicit token file without a role
+	if _, err := newWebIdentityRoleProvider(&Config{WebIdentityTokenFile: "token"}); err == nil {
+		t.Fatal("Expected an error for a token file without a role ARN")
+	}
+
+	// Explicit configuration
+	p, err = newWebIdentityRoleProvider(&Config{
+		WebIdentityTokenFile:  "token",
+		AssumeRoleARN:         "arn:aws:iam::123456789012:role/web-identity",
+		AssumeRoleSessionName: "terraform",
+	})
+	if err != nil {
+		t.Fatalf("Error creating web identity provider: %s", err)
+	}
+	if p.TokenFile != "token" || p.RoleARN != "arn:aws:iam::123456789012:role/web-identity" || p.RoleSessionName != "terraform" {
+		t.Fatalf("Unexpected web identity provider: %#v", p)
+	}
+
+	// Environment fallback
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "env-token")
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/env")
+	defer os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	defer os.Unsetenv("AWS_ROLE_ARN")
+
+	p, err = newWebIdentityRoleProvider(&Config{})
+	if err != nil {
+		t.Fatalf("Error creating web identity provider: %s", err)
+	}
+	if p == nil || p.TokenFile != "env-token" || p.RoleARN != "arn:aws:iam::123456789012:role/env" {
+		t.Fatalf("Unexpected web identity provider: %#v", p)
+	}
+
+	// Static credentials take precedence over the environment
+	p, err = newWebIdentityRoleProvider(&Config{AccessKey: "accesskey", SecretKey: "secretkey"})
+	if err != nil {
+		t.Fatalf("Error creating web identity provider: %s", err)
+	}
+	if p != nil {
+		t.Fatal("Expected no web identity provider with static credentials")
+	}
+}
+
+func TestAWSAssumeRole_sourceRole(t *testing.T) {
+	// Each role's credentials have its name as the access key, so the
+	// credentials used to assume each role can be checked.
+	type call struct{ roleARN, accessKey string }
+	var calls []call
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		roleARN := r.PostForm.Get("RoleArn")
+		accessKey := strings.Split(strings.Split(r.Header.Get("Authorization"), "Credential=")[1], "/")[0]
+		calls = append(calls, call{roleARN, accessKey})
+
+		name := roleARN[strings.LastIndex(roleARN, "/")+1:]
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, stsResponse_AssumeRole_valid, name)
+	}))
+	defer ts.Close()
+
+	c := &Config{
+		AssumeRoleARN:         "arn:aws:iam::123456789012:role/target",
+		AssumeRoleSourceARN:   "arn:aws:iam::123456789012:role/jump",
+		AssumeRoleSessionName: "terraform",
+	}
+	creds, err := assumeRole(c, &aws.Config{
+		Credentials: awsCredentials.NewStaticCredentials("accessKey", "secretKey", ""),
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(ts.URL),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "target" {
+		t.Fatalf("expected the credentials of the target role, got %q", v.AccessKeyID)
+	}
+
+	expected := []call{
+		{"arn:aws:iam::123456789012:role/jump", "accessKey"},
+		{"arn:aws:iam::123456789012:role/target", "jump"},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("expected AssumeRole calls %v, got %v", expected, calls)
+	}
+}
+
+func TestAWSGetCredentials_stsEndpoint(t *testing.T) {
+	resetEnv := unsetEnv(t)
+	defer resetEnv()
+
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, stsResponse_AssumeRole_valid, "target")
+	}))
+	defer ts.Close()
+
+	creds, err := GetCredentials(&Config{
+		AccessKey:            "accessKey",
+		SecretKey:            "secretKey",
+		Region:               "us-east-1",
+		AssumeRoleARN:        "arn:aws:iam::123456789012:role/target",
+		SkipMetadataApiCheck: true,
+		StsEndpoint:          ts.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.AccessKeyID != "target" {
+		t.Fatalf("expected the credentials of the role, got %q", v.AccessKeyID)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the role to be assumed with the STS endpoint, got %d calls", calls)
+	}
+}
+
+func TestAWSAssumeRoleProvider_duration(t *testing.T) {
+	c := &Config{
+		AssumeRoleARN:         "arn:aws:iam::123456789012:role/target",
+		AssumeRoleSessionName: "terraform",
+	}
+	if p := newAssumeRoleProvider(c, nil); p.Duration != 0 {
+		t.Fatalf("expected the default duration, got %s", p.Duration)
+	}
+
+	c.AssumeRoleDuration = 2 * time.Hour
+	p := newAssumeRoleProvider(c, nil)
+	if p.Duration != 2*time.Hour {
+		t.Fatalf("expected a duration of 2h, got %s", p.Duration)
+	}
+	if p.RoleARN != c.AssumeRoleARN || p.RoleSessionName != "terraform" {
+		t.Fatalf("bad provider: %#v", p)
+	}
+}
+
+func TestAWSAssumeRole_mfa(t *testing.T) {
+	var forms []url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		forms = append(forms, r.PostForm)
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, stsResponse_AssumeRole_valid, "target")
+	}))
+	defer ts.Close()
+
+	awsConfig := &aws.Config{
+		Credentials: awsCredentials.NewStaticCredentials("accessKey", "secretKey", ""),
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(ts.URL),
+	}
+	c := &Config{
+		AssumeRoleARN:          "arn:aws:iam::123456789012:role/target",
+		AssumeRoleSerialNumber: "arn:aws:iam::123456789012:mfa/user",
+		AssumeRoleTokenCode:    "123456",
+	}
+	if _, err := assumeRole(c, awsConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token provider is asked for the code instead.
+	c.AssumeRoleTokenCode = ""
+	c.AssumeRoleTokenProvider = func() (string, error) { return "654321", nil }
+	if _, err := assumeRole(c, awsConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(forms) != 2 {
+		t.Fatalf("expected 2 AssumeRole calls, got %d", len(forms))
+	}
+	for i, code := range []string{"123456", "654321"} {
+		if got := forms[i].Get("SerialNumber"); got != c.AssumeRoleSerialNumber {
+			t.Fatalf("call %d: expected serial number %q, got %q", i, c.AssumeRoleSerialNumber, got)
+		}
+		if got := forms[i].Get("TokenCode"); got != code {
+			t.Fatalf("call %d: expected token code %q, got %q", i, code, got)
+		}
+	}
+}
+
+func TestAWSWebIdentityRoleProvider(t *testing.T) {
+	file, err := ioutil.TempFile(os.TempDir(), "terraform_aws_web_identity")
+	if err != nil {
+		t.Fatalf("Error creating token file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString("test-token\n"); err != nil {
+		t.Fatalf("Error writing token file: %s", err)
+	}
+	file.Close()
+
+	stsEndpoints := []*awsMockEndpoint{
+		{
+			Request: &awsMockRequest{"POST", "/", "Action=AssumeRoleWithWebIdentity&" +
+				"RoleArn=arn%3Aaws%3Aiam%3A%3A123456789012%3Arole%2Fweb-identity&" +
+				"RoleSessionName=terraform&Version=2011-06-15&WebIdentityToken=test-token"},
+			Response: &awsMockResponse{200, stsResponse_AssumeRoleWithWebIdentity_valid, "text/xml"},
+		},
+	}
+	closeSts, stsSess, err := getMockedAwsApiSession("STS", stsEndpoints)
+	defer closeSts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := awsCredentials.NewCredentials(&WebIdentityRoleProvider{
+		Client:          sts.New(stsSess),
+		RoleARN:         "arn:aws:iam::123456789012:role/web-identity",
+		RoleSessionName: "terraform",
+		TokenFile:       file.Name(),
+	})
+
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	if v.ProviderName != WebIdentityRoleProviderName {
+		t.Fatalf("Expected provider %s, got %s", WebIdentityRoleProviderName, v.ProviderName)
+	}
+	if v.AccessKeyID != "ASIAWEBIDENTITY" {
+		t.Fatalf("AccessKeyID mismatch, expected: (%s), got (%s)", "ASIAWEBIDENTITY", v.AccessKeyID)
+	}
+	if v.SessionToken != "webidentitytoken" {
+		t.Fatalf("SessionToken mismatch, expected: (%s), got (%s)", "webidentitytoken", v.SessionToken)
+	}
+}
+
+func TestAWSGetCredentials_webIdentityEnvPrecedence(t *testing.T) {
+	resetEnv := unsetEnv(t)
+	defer resetEnv()
+	defer os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	defer os.Unsetenv("AWS_ROLE_ARN")
+
+	token, err := ioutil.TempFile(os.TempDir(), "terraform_aws_web_identity")
+	if err != nil {
+		t.Fatalf("Error creating token file: %s", err)
+	}
+	defer os.Remove(token.Name())
+	fmt.Fprintln(token, "test-token")
+	token.Close()
+
+	shared, err := ioutil.TempFile(os.TempDir(), "terraform_aws_cred")
+	if err != nil {
+		t.Fatalf("Error creating credentials file: %s", err)
+	}
+	defer os.Remove(shared.Name())
+	fmt.Fprint(shared, credentialsFileContents)
+	shared.Close()
+
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, stsResponse_AssumeRoleWithWebIdentity_valid)
+	}))
+	defer ts.Close()
+
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", token.Name())
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/web-identity")
+
+	get := func(c *Config) awsCredentials.Value {
+		c.SkipMetadataApiCheck = true
+		c.Region = "us-east-1"
+		c.StsEndpoint = ts.URL
+		creds, err := GetCredentials(c)
+		if err != nil {
+			t.Fatalf("Error gettings creds: %s", err)
+		}
+		v, err := creds.Get()
+		if err != nil {
+			t.Fatalf("Error gettings creds: %s", err)
+		}
+		return v
+	}
+
+	// A profile takes precedence over the token from the environment.
+	v := get(&Config{Profile: "myprofile", CredsFilename: shared.Name()})
+	if v.ProviderName != awsCredentials.SharedCredsProviderName || v.AccessKeyID != "accesskey" {
+		t.Fatalf("Expected the profile's credentials, got %s %q", v.ProviderName, v.AccessKeyID)
+	}
+
+	// So do keys from the environment.
+	os.Setenv("AWS_ACCESS_KEY_ID", "envkey")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	v = get(&Config{})
+	if v.ProviderName != awsCredentials.EnvProviderName || v.AccessKeyID != "envkey" {
+		t.Fatalf("Expected the environment's credentials, got %s %q", v.ProviderName, v.AccessKeyID)
+	}
+	if calls != 0 {
+		t.Fatalf("Expected no web identity exchange, got %d STS calls", calls)
+	}
+
+	// Without other credentials the token is used.
+	os.Unsetenv("AWS_ACCESS_KEY_ID")
+	os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+	v = get(&Config{CredsFilename: shared.Name(), Profile: "missing"})
+	if v.ProviderName != WebIdentityRoleProviderName || v.AccessKeyID != "ASIAWEBIDENTITY" {
+		t.Fatalf("Expected web identity credentials, got %s %q", v.ProviderName, v.AccessKeyID)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected one web identity exchange, got %d STS calls", calls)
+	}
+}
+
+func TestAWSGetCredentials_containerCredentials(t *testing.T) {
+	resetEnv := unsetEnv(t)
+	defer resetEnv()
+	defer os.Unsetenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	defer os.Unsetenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+
+	// An EKS Pod Identity agent, which requires the token from the token file.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/credentials" || r.Header.Get("Authorization") != "pod-token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, `{"Code": "AccessDeniedException", "Message": "bad token"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"AccessKeyId": "podkey", "SecretAccessKey": "podsecret", "Token": "podtoken", "Expiration": %q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer ts.Close()
+
+	tokenFile, err := ioutil.TempFile(os.TempDir(), "terraform_aws_cred")
+	if err != nil {
+		t.Fatalf("Error creating temporary file: %s", err)
+	}
+	defer os.Remove(tokenFile.Name())
+	fmt.Fprintln(tokenFile, "pod-token")
+	tokenFile.Close()
+
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", ts.URL+"/v1/credentials")
+	os.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile.Name())
+
+	creds, err := GetCredentials(&Config{SkipMetadataApiCheck: true})
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	if v.ProviderName != ContainerCredentialsProviderName {
+		t.Fatalf("Expected credentials from %s, got %s", ContainerCredentialsProviderName, v.ProviderName)
+	}
+	if v.AccessKeyID != "podkey" || v.SecretAccessKey != "podsecret" || v.SessionToken != "podtoken" {
+		t.Fatalf("Unexpected container credentials: %#v", v)
+	}
+
+	// Without the token the agent refuses the request.
+	os.Unsetenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+	p, err := newContainerCredentialsProvider()
+	if err != nil {
+		t.Fatalf("Error creating container credentials provider: %s", err)
+	}
+	if _, err := p.Retrieve(); err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Fatalf("Expected an error from the endpoint, got: %v", err)
+	}
+
+	// Credentials must not be fetched from other hosts in plain text.
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "http://example.com/v1/credentials")
+	if _, err := newContainerCredentialsProvider(); err == nil {
+		t.Fatal("Expected an error for a plain HTTP URI on another host")
+	}
+
+	// That endpoint is left out of the chain, and doesn't stop other
+	// credentials from being used.
+	creds, err = GetCredentials(&Config{AccessKey: "static", SecretKey: "secret", SkipMetadataApiCheck: true})
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	v, err = creds.Get()
+	if err != nil {
+		t.Fatalf("Error gettings creds: %s", err)
+	}
+	if v.AccessKeyID != "static" {
+		t.Fatalf("Expected the static credentials, got %#v", v)
+	}
+
+	// Without other credentials, the chain has none to offer rather than
+	// failing on the endpoint.
+	if _, err := GetCredentials(&Config{SkipMetadataApiCheck: true}); err != nil {
+		t.Fatalf("Expected the endpoint to be ignored, got: %s", err)
+	}
+}
+
+// writeCredentialProcess writes an executable shell script with the given
+// body and returns its path.
+func writeCredentialProcess(t *testing.T, body string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("credential process scripts require sh")
+	}
+
+	file, err := ioutil.TempFile(os.TempDir(), "terraform_aws_cred_process")
+	if err != nil {
+		t.Fatalf("Error creating credential process script: %s", err)
+	}
+	if _, err := file.WriteString("#!/bin/sh\n" + body + "\n"); err != nil {
+		t.Fatalf("Error writing credential process script: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Error closing credential process script: %s", err)
+	}
+	if err := os.Chmod(file.Name(), 0700); err != nil {
+		t.Fatalf("Error making credential process script executable: %s", err)
+	}
+	return file.Name()
+}
+
 // unsetEnv unsets environment variables for testing a "clean slate" with no
 // credentials in the environment
 func unsetEnv(t *testing.T) func() {
@@ -900,3 +1430,40 @@ const iamResponse_ListRoles_unauthorized = `<ErrorResponse xmlns="https://iam.am
   </Error>
   <RequestId>7a62c49f-347e-4fc4-9331-6e8eEXAMPLE</RequestId>
 </ErrorResponse>`
+
+const stsResponse_AssumeRole_valid = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/%[1]s/terraform</Arn>
+      <AssumedRoleId>AROA123EXAMPLE123:terraform</AssumedRoleId>
+    </AssumedRoleUser>
+    <Credentials>
+      <AccessKeyId>%[1]s</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+  <ResponseMetadata>
+    <RequestId>01234567-89ab-cdef-0123-456789abcdef</RequestId>
+  </ResponseMetadata>
+</AssumeRoleResponse>`
+
+const stsResponse_AssumeRoleWithWebIdentity_valid = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <SubjectFromWebIdentityToken>system:serviceaccount:default:terraform</SubjectFromWebIdentityToken>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/web-identity/terraform</Arn>
+      <AssumedRoleId>AROACLKWSDQRAOEXAMPLE:terraform</AssumedRoleId>
+    </AssumedRoleUser>
+    <Credentials>
+      <SessionToken>webidentitytoken</SessionToken>
+      <SecretAccessKey>webidentitysecret</SecretAccessKey>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+      <AccessKeyId>ASIAWEBIDENTITY</AccessKeyId>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+  <ResponseMetadata>
+    <RequestId>ad4156e9-bce1-11e2-82e6-6b6efEXAMPLE</RequestId>
+  </ResponseMetadata>
+</AssumeRoleWithWebIdentityResponse>`
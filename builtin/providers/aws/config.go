@@ -85,6 +85,19 @@ type Config struct {
 	AssumeRoleSessionName string
 	AssumeRolePolicy      string
 
+	// AssumeRoleSourceARN is a role that is assumed before AssumeRoleARN,
+	// for roles that can only be assumed from another role.
+	AssumeRoleSourceARN string
+	// AssumeRoleDuration is how long the assumed role's credentials last.
+	// Zero uses the SDK default of 15 minutes.
+	AssumeRoleDuration time.Duration
+	// AssumeRoleSerialNumber is the MFA device that the role requires, and
+	// AssumeRoleTokenCode the code it shows. AssumeRoleTokenProvider is
+	// asked for a code instead if it's set, e.g. to prompt for one.
+	AssumeRoleSerialNumber  string
+	AssumeRoleTokenCode     string
+	AssumeRoleTokenProvider func() (string, error)
+
 	AllowedAccountIds   []interface{}
 	ForbiddenAccountIds []interface{}
 
@@ -101,6 +114,26 @@ type Config struct {
 	SkipRequestingAccountId bool
 	SkipMetadataApiCheck    bool
 	S3ForcePathStyle        bool
+
+	// Ec2MetadataServiceEndpointMode selects the IPv4 or IPv6 endpoint of
+	// the EC2 metadata API. Defaults to IPv4.
+	Ec2MetadataServiceEndpointMode string
+	// Ec2MetadataDisableFallback requires IMDSv2 session tokens for the EC2
+	// metadata API, instead of falling back to IMDSv1 when no token can be
+	// fetched.
+	Ec2MetadataDisableFallback bool
+
+	// CredentialProcess is a command that prints credentials as JSON, like
+	// the credential_process setting of the AWS shared config file.
+	CredentialProcess string
+
+	// WebIdentityTokenFile is a file containing an OIDC token that is
+	// exchanged for credentials of AssumeRoleARN.
+	WebIdentityTokenFile string
+
+	// StsEndpoint is a custom endpoint for the STS requests that assume
+	// roles, such as a VPC endpoint.
+	StsEndpoint string
 }
 
 type AWSClient struct {
@@ -26,6 +26,9 @@ type ClientLocker interface {
 type Payload struct {
 	MD5  []byte
 	Data []byte
+
+	// Metadata is stored alongside the state by clients that support it.
+	Metadata map[string]string
 }
 
 // Factory is the factory function to create a remote client.
@@ -51,6 +51,18 @@ func TestRemoteClient_noPayload(t *testing.T) {
 	}
 }
 
+func TestRemoteClient_emptyPayload(t *testing.T) {
+	s := &State{
+		Client: emptyClient{},
+	}
+	if err := s.RefreshState(); err != nil {
+		t.Fatal("error refreshing empty remote state")
+	}
+	if s.State() != nil {
+		t.Fatalf("expected no state, got %#v", s.State())
+	}
+}
+
 // nilClient returns nil for everything
 type nilClient struct{}
 
@@ -59,3 +71,8 @@ func (nilClient) Get() (*Payload, error) { return nil, nil }
 func (c nilClient) Put([]byte) error { return nil }
 
 func (c nilClient) Delete() error { return nil }
+
+// emptyClient returns a zero-length payload
+type emptyClient struct{ nilClient }
+
+func (emptyClient) Get() (*Payload, error) { return &Payload{Data: []byte{}}, nil }
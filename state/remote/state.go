@@ -35,8 +35,8 @@ func (s *State) RefreshState() error {
 		return err
 	}
 
-	// no remote state is OK
-	if payload == nil {
+	// no remote state is OK, and neither is empty remote state
+	if payload == nil || len(payload.Data) == 0 {
 		return nil
 	}
 
@@ -177,3 +177,9 @@ func (e *LockError) Error() string {
 	}
 	return strings.Join(out, "\n")
 }
+
+// Unwrap returns the underlying error, so that it can be checked with
+// errors.Is and errors.As on Go 1.13 and later.
+func (e *LockError) Unwrap() error {
+	return e.Err
+}